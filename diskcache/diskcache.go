@@ -0,0 +1,251 @@
+// Package diskcache implements a size-bounded LRU cache of blobs on local
+// disk, with a per-entry expiry that survives restarts.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Each file starts with the expiry time as big endian unix nanoseconds.
+	headerSize = 8
+
+	tempPrefix = "tmp-"
+)
+
+type entry struct {
+	name    string
+	size    int64
+	expires time.Time
+	elem    *list.Element
+}
+
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	index map[string]*entry
+	// Most recently used first.
+	lru   *list.List
+	bytes int64
+}
+
+// New opens a cache in dir, creating it if needed, and indexes any entries
+// left by a previous run. A maxBytes of 0 means no size limit.
+func New(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    make(map[string]*entry),
+		lru:      list.New(),
+	}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("load %s: %v", dir, err)
+	}
+	log.Infof("Disk tile cache at %s has %d entries, %d bytes", dir, len(c.index), c.bytes)
+	return c, nil
+}
+
+// load indexes existing files, treating the most recently written as the
+// most recently used.
+func (c *DiskCache) load() error {
+	type found struct {
+		e   *entry
+		mod time.Time
+	}
+	var all []found
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			os.Remove(path) // Left over from an interrupted write.
+			return nil
+		}
+		if !validName(d.Name()) || path != c.path(d.Name()) {
+			// Not ours, so neither counted nor removed.
+			log.Warnf("Ignoring unknown file %s in cache directory", path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		expires, err := readExpiry(path)
+		if err != nil {
+			log.Warnf("Removing unreadable cache file %s: %v", path, err)
+			os.Remove(path)
+			return nil
+		}
+		all = append(all, found{
+			e:   &entry{name: d.Name(), size: info.Size(), expires: expires},
+			mod: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mod.After(all[j].mod)
+	})
+	for _, f := range all {
+		f.e.elem = c.lru.PushBack(f.e)
+		c.index[f.e.name] = f.e
+		c.bytes += f.e.size
+	}
+	c.evict()
+	return nil
+}
+
+func readExpiry(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(hdr[:]))), nil
+}
+
+func nameFor(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// validName reports whether a file name could have come from nameFor.
+func validName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// path shards files into subdirectories to keep directories small.
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// remove drops an entry and its file. Must be called with the lock held.
+func (c *DiskCache) remove(e *entry) {
+	c.lru.Remove(e.elem)
+	delete(c.index, e.name)
+	c.bytes -= e.size
+	if err := os.Remove(c.path(e.name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove cache file: %v", err)
+	}
+}
+
+// evict removes least recently used entries until within the size limit.
+// Must be called with the lock held.
+func (c *DiskCache) evict() {
+	for c.maxBytes > 0 && c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+}
+
+// Get returns the cached value for key, if present and not expired.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	name := nameFor(key)
+	c.mu.Lock()
+	e, ok := c.index[name]
+	if ok && time.Now().After(e.expires) {
+		c.remove(e)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// Read without the lock so reads run in parallel. Files are replaced by
+	// rename, so the read sees either a whole file or none.
+	b, err := os.ReadFile(c.path(name))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index[name] != e {
+		// Replaced or removed while reading, so the data may be stale.
+		return nil, false
+	}
+	if err != nil || len(b) < headerSize {
+		log.Warnf("Failed to read cache file: %v", err)
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e.elem)
+	return b[headerSize:], true
+}
+
+// Put stores a value for key that expires after ttl.
+func (c *DiskCache) Put(key string, value []byte, ttl time.Duration) error {
+	name := nameFor(key)
+	expires := time.Now().Add(ttl)
+
+	// Write to a temporary file first so readers never see partial data.
+	dir := filepath.Dir(c.path(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	var hdr [headerSize]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(expires.UnixNano()))
+	_, err = f.Write(hdr[:])
+	if err == nil {
+		_, err = f.Write(value)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.index[name]; ok {
+		c.lru.Remove(e.elem)
+		delete(c.index, name)
+		c.bytes -= e.size
+	}
+	if err := os.Rename(f.Name(), c.path(name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	e := &entry{
+		name:    name,
+		size:    int64(headerSize + len(value)),
+		expires: expires,
+	}
+	e.elem = c.lru.PushFront(e)
+	c.index[name] = e
+	c.bytes += e.size
+	c.evict()
+	return nil
+}
@@ -0,0 +1,92 @@
+package diskcache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForeignFilesIgnored(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"x", "README", nameFor("misplaced")} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := New(dir, 16)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if c.bytes != 0 || len(c.index) != 0 {
+		t.Errorf("indexed %d foreign files, %d bytes", len(c.index), c.bytes)
+	}
+	// Filling the cache past its limit evicts only our own entries.
+	for _, key := range []string{"a", "b"} {
+		if err := c.Put(key, []byte("value"), time.Hour); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x")); err != nil {
+		t.Errorf("foreign file removed: %v", err)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) hit after eviction")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Get(b) missed")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.Put("live", []byte("live"), time.Hour)
+	c.Put("expired", []byte("expired"), -time.Second)
+
+	c, err = New(dir, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if b, ok := c.Get("live"); !ok || string(b) != "live" {
+		t.Errorf("Get(live) = %q, %v", b, ok)
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Errorf("Get(expired) hit")
+	}
+}
+
+func TestConcurrentGetPut(t *testing.T) {
+	c, err := New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	values := [][]byte{bytes.Repeat([]byte{1}, 4096), bytes.Repeat([]byte{2}, 8192)}
+	c.Put("key", values[0], time.Hour)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if i == 0 {
+					c.Put("key", values[j%2], time.Hour)
+					continue
+				}
+				b, ok := c.Get("key")
+				if ok && !bytes.Equal(b, values[0]) && !bytes.Equal(b, values[1]) {
+					t.Errorf("Get returned a mix of values, %d bytes", len(b))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -4,17 +4,20 @@ go 1.18
 
 require (
 	cloud.google.com/go/datastore v1.6.0
+	github.com/chai2010/webp v1.4.0
 	github.com/davecgh/go-spew v1.1.1
 	github.com/eidolon/wordwrap v0.0.0-20161011182207-e0f54129b8bb
-	github.com/furstenheim/go-convex-hull-2d v0.0.0-20181121204724-08788ab09726
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/go-retryablehttp v0.7.0
 	github.com/jinzhu/copier v0.3.5
 	github.com/llgcode/draw2d v0.0.0-20210904075650-80aa0a2a901d
 	github.com/paulmach/orb v0.4.0
+	github.com/peterstace/simplefeatures v0.50.0
 	github.com/sirupsen/logrus v1.8.1
+	github.com/tidwall/rtree v1.10.0
 	golang.org/x/image v0.0.0-20220321031419-a8550c1d254a
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/time v0.3.0
 )
 
 require (
@@ -26,6 +29,7 @@ require (
 	github.com/google/go-cmp v0.5.7 // indirect
 	github.com/googleapis/gax-go/v2 v2.2.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
+	github.com/tidwall/geoindex v1.7.0 // indirect
 	go.opencensus.io v0.23.0 // indirect
 	golang.org/x/net v0.0.0-20220403103023-749bd193bc2b // indirect
 	golang.org/x/oauth2 v0.0.0-20220309155454-6242fa91716a // indirect
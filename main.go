@@ -8,12 +8,15 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"planet-server/diskcache"
 	"planet-server/metaserver"
 	"planet-server/planet"
 	"planet-server/thumbserver"
+	"planet-server/tilecache"
 	"planet-server/tileserver"
 	"planet-server/util"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,6 +29,39 @@ var (
 	port  = flag.Int("port", util.EnvOrDefaultInt("PORT", 8080), "Serving port")
 	debug = flag.Bool("debug", false, "Enable debug logging verbosity")
 
+	apiURL    = flag.String("api_url", util.EnvOrDefault("PLANET_API_URL", planet.DefaultAPIURL), "Base URL of the Planet data API")
+	tileHost  = flag.String("tile_host", util.EnvOrDefault("PLANET_TILE_HOST", planet.DefaultTileHost), "Planet tile host; %d is replaced with a shard number")
+	thumbHost = flag.String("thumb_host", util.EnvOrDefault("PLANET_THUMB_HOST", ""), "Planet thumbnail host; defaults to the tile host")
+
+	itemTypes = flag.String("item_types", util.EnvOrDefault("PLANET_ITEM_TYPES", strings.Join(planet.DefaultItemTypes, ",")), "Comma separated Planet item types that may be browsed")
+
+	searchMaxPages = flag.Int("search_max_pages", util.EnvOrDefaultInt("SEARCH_MAX_PAGES", planet.DefaultMaxPages), "Maximum number of result pages fetched per search; negative for no limit")
+	searchMaxItems = flag.Int("search_max_items", util.EnvOrDefaultInt("SEARCH_MAX_ITEMS", planet.DefaultMaxItems), "Maximum number of results fetched per search; negative for no limit")
+	searchMaxDays  = flag.Int("search_max_days", util.EnvOrDefaultInt("SEARCH_MAX_DAYS", int(metaserver.DefaultMaxSearchSpan.Hours()/24)), "Longest search window in days; 0 for no limit")
+
+	cacheMaxEntries = flag.Int("cache_max_entries", util.EnvOrDefaultInt("CACHE_MAX_ENTRIES", tilecache.DefaultMaxEntries), "Maximum number of cached search regions across all pools; 0 for no limit")
+	cacheMaxMB      = flag.Int("cache_max_mb", util.EnvOrDefaultInt("CACHE_MAX_MB", tilecache.DefaultMaxBytes>>20), "Maximum estimated size of cached search results in MB; 0 for no limit")
+	cacheIdleMins   = flag.Int("cache_idle_minutes", util.EnvOrDefaultInt("CACHE_IDLE_MINUTES", int(tilecache.DefaultIdleTimeout.Minutes())), "Drop search cache pools unused for this many minutes; 0 to keep forever")
+
+	sceneCacheTiles = flag.Int("scene_cache_tiles", util.EnvOrDefaultInt("SCENE_CACHE_TILES", planet.DefaultSceneCacheSize), "Number of upstream scene tiles cached in memory; negative to disable")
+
+	searchRate    = flag.Float64("search_rate", util.EnvOrDefaultFloat("SEARCH_RATE", planet.DefaultSearchRate), "Upstream search requests per second; negative for no limit")
+	tileRate      = flag.Float64("tile_rate", util.EnvOrDefaultFloat("TILE_RATE", planet.DefaultTileRate), "Upstream tile requests per second; negative for no limit")
+	thumbRate     = flag.Float64("thumb_rate", util.EnvOrDefaultFloat("THUMB_RATE", planet.DefaultThumbRate), "Upstream thumbnail requests per second; negative for no limit")
+	dailyBudget   = flag.Int("daily_budget", util.EnvOrDefaultInt("DAILY_BUDGET", 0), "Maximum upstream API calls per UTC day, counted in memory per instance and reset on restart; 0 for no limit")
+	monthlyBudget = flag.Int("monthly_budget", util.EnvOrDefaultInt("MONTHLY_BUDGET", 0), "Maximum upstream API calls per UTC month, counted in memory per instance and reset on restart; 0 for no limit")
+
+	tileCacheDir = flag.String("tile_cache_dir", util.EnvOrDefault("TILE_CACHE_DIR", ""), "Directory for caching rendered tiles on disk; empty to disable")
+	tileCacheMB  = flag.Int("tile_cache_mb", util.EnvOrDefaultInt("TILE_CACHE_MB", 1024), "Maximum size of the disk tile cache in MB; 0 for no limit")
+
+	tileErrorStatus = flag.Bool("tile_error_status", util.EnvOrDefaultBool("TILE_ERROR_STATUS", false), "Return 4xx/5xx status codes for failed tiles instead of 200")
+	tileErrorBody   = flag.Bool("tile_error_body", util.EnvOrDefaultBool("TILE_ERROR_BODY", true), "Render an error tile as the body of failed tile responses")
+
+	jpegQuality = flag.Int("jpeg_quality", util.EnvOrDefaultInt("JPEG_QUALITY", tileserver.DefaultJPEGQuality), "Default quality of JPEG tiles, 1 to 100")
+	webpQuality = flag.Int("webp_quality", util.EnvOrDefaultInt("WEBP_QUALITY", tileserver.DefaultWebPQuality), "Default quality of WebP tiles, 1 to 100")
+
+	overviewBudget = flag.Int("overview_budget", util.EnvOrDefaultInt("OVERVIEW_BUDGET", tileserver.DefaultOverviewBudget), "Upstream API calls allowed per low zoom overview tile; 0 to disable overviews. Overviews require TILE_CACHE_DIR")
+
 	// Timestamp that can be set with ldflags for versioning.
 	// Expected to be empty, or unix seconds.
 	BuildTimestamp string
@@ -53,16 +89,53 @@ func main() {
 		log.Debugf("Debug logging enabled")
 	}
 
-	pl := planet.New(ctx)
+	pl := planet.New(ctx, planet.Options{
+		APIURL:    *apiURL,
+		TileHost:  *tileHost,
+		ThumbHost: *thumbHost,
+		ItemTypes: util.SplitList(*itemTypes),
+		MaxPages:  *searchMaxPages,
+		MaxItems:  *searchMaxItems,
+
+		SceneCacheSize: *sceneCacheTiles,
+
+		SearchRate:    *searchRate,
+		TileRate:      *tileRate,
+		ThumbRate:     *thumbRate,
+		DailyBudget:   int64(*dailyBudget),
+		MonthlyBudget: int64(*monthlyBudget),
+	})
 	ts := tileserver.New(pl)
+	ts.Cache.Limits = tilecache.Limits{
+		MaxEntries:  *cacheMaxEntries,
+		MaxBytes:    int64(*cacheMaxMB) << 20,
+		IdleTimeout: time.Duration(*cacheIdleMins) * time.Minute,
+	}
+	ts.ErrorStatus = *tileErrorStatus
+	ts.ErrorBody = *tileErrorBody
+	ts.JPEGQuality = *jpegQuality
+	ts.WebPQuality = *webpQuality
+	ts.OverviewBudget = *overviewBudget
+	if *tileCacheDir != "" {
+		dc, err := diskcache.New(*tileCacheDir, int64(*tileCacheMB)<<20)
+		if err != nil {
+			log.Fatalf("disk tile cache: %v", err)
+		}
+		ts.Disk = dc
+	}
 	ms := metaserver.New(pl)
+	ms.MaxSearchSpan = time.Duration(*searchMaxDays) * 24 * time.Hour
 	ths := thumbserver.New(pl)
 
 	router := mux.NewRouter()
-	router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", ts).Methods("GET")
+	// Tiles without an extension are encoded according to the Accept header.
+	// An @2x suffix serves 512px tiles for high-DPI displays.
+	router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}", ts).Methods("GET")
+	router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}.{ext:png|jpg|jpeg|webp}", ts).Methods("GET")
 	router.Handle("/api/thumb/{id:[A-Za-z0-9_-]+}.png", ths).Methods("GET")
-	router.Handle("/api/search", ms).Methods("GET")
+	router.Handle("/api/search", ms).Methods("GET", "POST")
 	router.HandleFunc("/api/key", pl.ServeKeySaveHandler).Methods("POST")
+	router.HandleFunc("/api/usage", pl.ServeUsageHandler).Methods("GET")
 
 	router.HandleFunc("/api/build", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
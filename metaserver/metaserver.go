@@ -2,11 +2,15 @@ package metaserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"planet-server/planet"
 	"planet-server/util"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -19,22 +23,49 @@ import (
 
 const (
 	SearchBoundExpand = 1
+
+	// Largest accepted posted region geometry.
+	MaxRegionBytes = 1 << 20
+
+	// Search window used when the request doesn't specify one.
+	DefaultSearchDays = 30
+	// Default limit on the span of a search window.
+	DefaultMaxSearchSpan = 2 * 365 * 24 * time.Hour
+)
+
+var (
+	ErrRegionTooLarge = errors.New("region too large")
 )
 
 type MetaServer struct {
 	Client *planet.Client
+
+	// Longest search window a request may ask for.
+	MaxSearchSpan time.Duration
 }
 
 func New(p *planet.Client) *MetaServer {
-	return &MetaServer{Client: p}
-
+	return &MetaServer{
+		Client:        p,
+		MaxSearchSpan: DefaultMaxSearchSpan,
+	}
 }
 
 type metaRequest struct {
-	Lat     float64
-	Lng     float64
-	Z       int
+	// Area of interest, from a point and zoom, a bbox or a posted geometry.
+	Region orb.Geometry
+
 	GroupBy string
+
+	// Acquisition window to search.
+	Start time.Time
+	End   time.Time
+
+	ItemTypes []string
+	Quality   planet.Quality
+	// Mosaic ordering and compositing passed through to tile URLs.
+	Sort      planet.SortOrder
+	Composite planet.Composite
 }
 
 type metaEntry struct {
@@ -48,6 +79,10 @@ type metaEntry struct {
 	Geometry    *geojson.Geometry `json:"geometry"`
 	SatelliteID string            `json:"satellite_id"`
 	ID          string            `json:"id"`
+	ItemType    string            `json:"item_type"`
+
+	// Fraction of the searched area covered by the scene footprints.
+	Coverage float64 `json:"coverage"`
 
 	TileURL string `json:"tile_url"`
 }
@@ -55,40 +90,195 @@ type metaEntry struct {
 type metaResponse struct {
 	Results []*metaEntry `json:"results"`
 	Error   string       `json:"error"`
+
+	// Set when the search hit the configured result limits.
+	Truncated bool `json:"truncated,omitempty"`
 }
 
-func parseRequest(r *http.Request) (*metaRequest, error) {
-	r.ParseForm()
-	req := &metaRequest{
-		GroupBy: r.Form.Get("group_by"),
+// mosaicValues returns the tile URL parameters shared by all mosaic results.
+func (req *metaRequest) mosaicValues() url.Values {
+	v := req.Quality.Values()
+	v.Set("item_types", strings.Join(req.ItemTypes, ","))
+	if req.Sort != planet.SortNewest {
+		v.Set("sort", string(req.Sort))
+	}
+	if req.Composite != planet.CompositeOver {
+		v.Set("composite", string(req.Composite))
+	}
+	return v
+}
+
+// parseWindow reads the search window from the optional start and end dates
+// (inclusive) and days parameters. The window ends now and spans
+// DefaultSearchDays unless otherwise specified.
+func (s *MetaServer) parseWindow(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+
+	end = now
+	if v := r.Form.Get("end"); v != "" {
+		end, err = util.ParseDate(v)
+		if err != nil {
+			return start, end, fmt.Errorf("bad end: %v", err)
+		}
+		end = end.AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+	}
+
+	days := DefaultSearchDays
+	if v := r.Form.Get("days"); v != "" {
+		if r.Form.Get("start") != "" {
+			return start, end, fmt.Errorf("days and start are mutually exclusive")
+		}
+		days, err = strconv.Atoi(v)
+		if err != nil {
+			return start, end, fmt.Errorf("bad days: %v", err)
+		}
+		if days <= 0 {
+			return start, end, fmt.Errorf("bad days: %d not positive", days)
+		}
+	}
+
+	if v := r.Form.Get("start"); v != "" {
+		start, err = util.ParseDate(v)
+		if err != nil {
+			return start, end, fmt.Errorf("bad start: %v", err)
+		}
+	} else {
+		start = end.AddDate(0, 0, -days)
+	}
+
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("start %v not before end %v", start, end)
+	}
+	if s.MaxSearchSpan > 0 && end.Sub(start) > s.MaxSearchSpan {
+		return start, end, fmt.Errorf("search window exceeds %d days", int(s.MaxSearchSpan.Hours()/24))
+	}
+	return start, end, nil
+}
+
+// readRegion reads a posted GeoJSON region geometry.
+func readRegion(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxRegionBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("read region: %v", err)
+	}
+	if len(body) > MaxRegionBytes {
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrRegionTooLarge, MaxRegionBytes)
+	}
+	return body, nil
+}
+
+// parseRegion reads the area of interest from a posted GeoJSON geometry, a
+// bbox=west,south,east,north parameter, or a lat/lng/z point.
+func parseRegion(r *http.Request, body []byte) (orb.Geometry, error) {
+	if r.Method == http.MethodPost {
+		g, err := geojson.UnmarshalGeometry(body)
+		if err != nil {
+			return nil, fmt.Errorf("bad region geometry: %v", err)
+		}
+		switch g.Geometry().(type) {
+		case orb.Polygon, orb.MultiPolygon:
+			return g.Geometry(), nil
+		}
+		return nil, fmt.Errorf("region must be a Polygon or MultiPolygon, got %s", g.Type)
 	}
+
+	if bbox := r.Form.Get("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("bad bbox %q: want west,south,east,north", bbox)
+		}
+		var v [4]float64
+		for i, p := range parts {
+			var err error
+			v[i], err = strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad bbox: %v", err)
+			}
+		}
+		b := orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}
+		if b.Min.X() >= b.Max.X() || b.Min.Y() >= b.Max.Y() ||
+			b.Min.X() < -180 || b.Max.X() > 180 || b.Min.Y() < -90 || b.Max.Y() > 90 {
+			return nil, fmt.Errorf("bad bbox %q", bbox)
+		}
+		return b.ToPolygon(), nil
+	}
+
 	var err error
-	lat := r.Form.Get("lat")
-	if lat == "" {
+	var lat, lng float64
+	var z int
+	latv := r.Form.Get("lat")
+	if latv == "" {
 		return nil, fmt.Errorf("missing lat")
 	}
-	req.Lat, err = strconv.ParseFloat(lat, 64)
+	lat, err = strconv.ParseFloat(latv, 64)
 	if err != nil {
 		return nil, fmt.Errorf("bad lat: %v", err)
 	}
-	lng := r.Form.Get("lng")
-	if lng == "" {
+	lngv := r.Form.Get("lng")
+	if lngv == "" {
 		return nil, fmt.Errorf("missing lng")
 	}
-	req.Lng, err = strconv.ParseFloat(lng, 64)
+	lng, err = strconv.ParseFloat(lngv, 64)
 	if err != nil {
 		return nil, fmt.Errorf("bad lng: %v", err)
 	}
-	z := r.Form.Get("z")
-	if z == "" {
+	zv := r.Form.Get("z")
+	if zv == "" {
 		return nil, fmt.Errorf("missing z")
 	}
-	req.Z, err = strconv.Atoi(z)
+	z, err = strconv.Atoi(zv)
 	if err != nil {
 		return nil, fmt.Errorf("bad z: %v", err)
 	}
-	if req.Z < 12 {
-		req.Z = 12
+	if z < 12 {
+		z = 12
+	}
+	tile := maptile.At(orb.Point{lng, lat}, maptile.Zoom(z))
+	return tile.Bound(SearchBoundExpand).ToPolygon(), nil
+}
+
+func (s *MetaServer) parseRequest(r *http.Request) (*metaRequest, error) {
+	var body []byte
+	if r.Method == http.MethodPost {
+		// Read first, as ParseForm consumes form encoded bodies such as those
+		// sent by curl -d.
+		var err error
+		if body, err = readRegion(r); err != nil {
+			return nil, err
+		}
+	}
+	r.ParseForm()
+	req := &metaRequest{
+		GroupBy: r.Form.Get("group_by"),
+	}
+	var err error
+	req.Region, err = parseRegion(r, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Start, req.End, err = s.parseWindow(r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req.ItemTypes, err = s.Client.ParseItemTypes(r.Form.Get("item_types"))
+	if err != nil {
+		return nil, err
+	}
+	req.Quality, err = planet.ParseQuality(r.Form)
+	if err != nil {
+		return nil, err
+	}
+	req.Sort, err = planet.ParseSortOrder(r.Form.Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+	req.Composite, err = planet.ParseComposite(r.Form.Get("composite"))
+	if err != nil {
+		return nil, err
 	}
 	return req, nil
 }
@@ -109,6 +299,15 @@ func sameSatellite(f1, f2 *planet.Feature) bool {
 	return f1.Properties.SatelliteID == f2.Properties.SatelliteID && delta < time.Hour
 }
 
+// footprint returns the feature geometry, which may be a Polygon or a
+// MultiPolygon, or nil if the feature has none.
+func footprint(f *planet.Feature) orb.Geometry {
+	if f.Geometry == nil {
+		return nil
+	}
+	return f.Geometry.Geometry()
+}
+
 func mergeFeature(base, other *planet.Feature) *planet.Feature {
 	ret := &planet.Feature{}
 	copier.Copy(ret, base)
@@ -128,7 +327,7 @@ func mergeFeature(base, other *planet.Feature) *planet.Feature {
 
 	if sameSatellite(base, other) {
 		// These are from the same satellite pass, merge them.
-		ret.Geometry = geojson.NewGeometry(util.GeoUnion(base.Geometry.Geometry(), other.Geometry.Geometry()))
+		ret.Geometry = geojson.NewGeometry(util.GeoUnion(footprint(base), footprint(other)))
 	} else {
 		ret.Geometry = nil
 		ret.Properties.SatelliteID = ""
@@ -139,26 +338,53 @@ func mergeFeature(base, other *planet.Feature) *planet.Feature {
 
 type equality func(f1, f2 *planet.Feature) bool
 
+// group is a result entry along with the features merged into it.
+type group struct {
+	*planet.Feature
+	Members []*planet.Feature
+}
+
+func ungrouped(features []*planet.Feature) []*group {
+	var ret []*group
+	for _, f := range features {
+		ret = append(ret, &group{Feature: f, Members: []*planet.Feature{f}})
+	}
+	return ret
+}
+
 // TODO something better than this awful O(N^2) thing
-func flatten(is_equal equality, features []*planet.Feature) []*planet.Feature {
-	var ret []*planet.Feature
+func flatten(is_equal equality, features []*planet.Feature) []*group {
+	var ret []*group
 outer:
 	for _, nf := range features {
 		for i := len(ret) - 1; i >= 0; i-- {
-			ef := ret[i]
-			if is_equal(nf, ef) {
-				ret[i] = mergeFeature(ef, nf)
+			eg := ret[i]
+			if is_equal(nf, eg.Feature) {
+				eg.Feature = mergeFeature(eg.Feature, nf)
+				eg.Members = append(eg.Members, nf)
 				continue outer
 			}
 		}
-		ret = append(ret, nf)
+		ret = append(ret, &group{Feature: nf, Members: []*planet.Feature{nf}})
 	}
 	return ret
 }
 
+// coverage returns the fraction of the region covered by the group members.
+func (g *group) coverage(region orb.Geometry) float64 {
+	var footprints []orb.Geometry
+	for _, f := range g.Members {
+		if g := footprint(f); g != nil {
+			footprints = append(footprints, g)
+		}
+	}
+	return util.Coverage(region, footprints...)
+}
+
 func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonError := func(err error, code int) {
+		planet.SetRetryAfter(w, err)
 		w.WriteHeader(code)
 		mr := &metaResponse{Error: err.Error()}
 		if err := json.NewEncoder(w).Encode(mr); err != nil {
@@ -166,44 +392,47 @@ func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	req, err := parseRequest(r)
+	req, err := s.parseRequest(r)
 	if err != nil {
 		log.Errorf("meta parseRequest: %v", err)
-		jsonError(err, http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrRegionTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		jsonError(err, code)
 		return
 	}
 
 	log.Debugf("Search request: %+v", spew.Sdump(req))
 
-	tile := maptile.At(orb.Point{req.Lng, req.Lat}, maptile.Zoom(req.Z))
-	region := tile.Bound(SearchBoundExpand)
-
-	end := time.Now()
-	start := end.Add(-30 * 24 * time.Hour)
+	search := planet.RequestGeometry(req.Region, req.Start, req.End, req.ItemTypes)
+	req.Quality.Apply(search)
 
 	t := time.Now()
-	resp, err := s.Client.QuickSearch(r.Context(), planet.RequestRegion(region, start, end))
+	resp, err := s.Client.QuickSearchAll(r.Context(), search)
 	if err != nil {
-		log.Errorf("meta QuickSearch: %v", err)
-		jsonError(err, http.StatusInternalServerError)
+		log.Errorf("meta QuickSearchAll: %v", err)
+		jsonError(err, planet.StatusCode(err))
 		return
 	}
 	log.Debugf("API search in %v", time.Since(t))
 
-	var features []*planet.Feature
+	var groups []*group
 
 	switch req.GroupBy {
 	case "date":
-		features = flatten(sameDate, resp.Features)
+		groups = flatten(sameDate, resp.Features)
 	case "satellite":
-		features = flatten(sameSatellite, resp.Features)
+		groups = flatten(sameSatellite, resp.Features)
 	default:
-		features = resp.Features
+		groups = ungrouped(resp.Features)
 	}
 
-	mr := &metaResponse{}
-	for _, f := range features {
-		url := "/api/tile/{z}/{x}/{y}.png"
+	mr := &metaResponse{Truncated: resp.Truncated}
+	for _, g := range groups {
+		f := g.Feature
+		// Without an extension the tile format is negotiated per tile.
+		tileURL := "/api/tile/{z}/{x}/{y}"
 
 		// TODO: would be nice to use the tile server for the mosaic thumbnail
 		// previews, but it's pretty slow, Unfortunately it requires a ton of API
@@ -219,16 +448,23 @@ func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		//}
 		//thumb := fmt.Sprintf("/api/tile/%d/%d/%d.png", ptile.Z, ptile.X, ptile.Y)
 
+		var v url.Values
 		switch req.GroupBy {
 		case "date":
-			url += "?date=" + dateOfFeature(f)
+			v = req.mosaicValues()
+			v.Set("date", dateOfFeature(f))
 		case "satellite":
-			url += "?satellite_id=" + f.Properties.SatelliteID + "&ts=" + fmt.Sprintf("%d", f.Properties.Acquired.Unix())
+			v = req.mosaicValues()
+			v.Set("satellite_id", f.Properties.SatelliteID)
+			v.Set("ts", fmt.Sprintf("%d", f.Properties.Acquired.Unix()))
 		default:
-			url += "?id=" + f.ID
+			v = make(url.Values)
+			v.Set("id", f.ID)
+			v.Set("item_type", f.Properties.ItemType)
 		}
+		tileURL += "?" + v.Encode()
 		mr.Results = append(mr.Results, &metaEntry{
-			Thumb:          fmt.Sprintf("/api/thumb/%s.png", f.ID),
+			Thumb:          fmt.Sprintf("/api/thumb/%s.png?item_type=%s", f.ID, f.Properties.ItemType),
 			Acquired:       f.Properties.Acquired,
 			VisiblePercent: f.Properties.VisiblePercent,
 			ClearPercent:   f.Properties.ClearPercent,
@@ -236,7 +472,9 @@ func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Geometry:       f.Geometry,
 			SatelliteID:    f.Properties.SatelliteID,
 			ID:             f.ID,
-			TileURL:        url,
+			ItemType:       f.Properties.ItemType,
+			TileURL:        tileURL,
+			Coverage:       g.coverage(req.Region),
 		})
 	}
 
@@ -1,12 +1,12 @@
 package planet
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/go-retryablehttp"
 	"net/url"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,52 +14,102 @@ import (
 )
 
 var (
-	// Simple way to do client-side rate limiting. This is needed to stay under
-	// planet quota.
+	// Bounds concurrent searches; request rate is limited separately by the
+	// client's quota.
 	MaxConcurrent = semaphore.NewWeighted(3)
 )
 
-// QuickSearch queries the /quick-search planet API endpoint.
-func (p *Client) QuickSearch(pctx context.Context, req *Request) (*Response, error) {
+// QuickSearch queries the /quick-search planet API endpoint. Only the first
+// page of results is returned; use QuickSearchAll to follow pagination.
+func (p *Client) QuickSearch(ctx context.Context, req *Request) (*Response, error) {
+	j, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("api encode: %v", err)
+	}
+	log.Debugf("Making API request %q", string(j))
+
+	v := make(url.Values)
+	v.Add("_sort", "acquired desc")
+	if p.opts.PageSize > 0 {
+		v.Add("_page_size", strconv.Itoa(p.opts.PageSize))
+	}
+	return p.searchPage(ctx, "POST", p.opts.APIURL+"/quick-search?"+v.Encode(), j)
+}
+
+// QuickSearchAll queries the /quick-search planet API endpoint and follows
+// the next page links until results are exhausted or the configured
+// MaxPages / MaxItems limits are reached.
+func (p *Client) QuickSearchAll(ctx context.Context, req *Request) (*Response, error) {
+	resp, err := p.QuickSearch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	out := &Response{Features: resp.Features}
+
+	for pages := 1; ; pages++ {
+		if p.opts.MaxItems > 0 && len(out.Features) >= p.opts.MaxItems {
+			out.Truncated = len(out.Features) > p.opts.MaxItems || resp.Links.next() != ""
+			out.Features = out.Features[:p.opts.MaxItems]
+			break
+		}
+		next := resp.Links.next()
+		if next == "" {
+			break
+		}
+		if p.opts.MaxPages > 0 && pages >= p.opts.MaxPages {
+			out.Truncated = true
+			break
+		}
+		resp, err = p.searchPage(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", pages+1, err)
+		}
+		out.Features = append(out.Features, resp.Features...)
+	}
+
+	if out.Truncated {
+		log.Warnf("Search truncated to %d results", len(out.Features))
+	}
+	return out, nil
+}
+
+func (p *Client) searchPage(pctx context.Context, method, url string, body []byte) (*Response, error) {
 	ctx, cancel := context.WithDeadline(pctx, time.Now().Add(15*time.Second))
 	defer cancel()
 
+	ctx = withQuota(ctx, p.quota, ClassSearch)
 	if err := MaxConcurrent.Acquire(ctx, 1); err != nil {
 		return nil, fmt.Errorf("api max concurrent: %v", err)
 	}
 	defer MaxConcurrent.Release(1)
 
-	j, err := json.Marshal(req)
-	if err != nil {
-		return nil, fmt.Errorf("api encode: %v", err)
+	var rawBody interface{}
+	if body != nil {
+		rawBody = body
 	}
-	log.Debugf("Making API request %q", string(j))
-
-	v := make(url.Values)
-	v.Add("_sort", "acquired desc")
-	r, err := retryablehttp.NewRequest("POST", "https://api.planet.com/data/v1/quick-search?"+v.Encode(), j)
+	r, err := retryablehttp.NewRequest(method, url, rawBody)
 	if err != nil {
 		return nil, err
 	}
 
-	r.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
 	r.SetBasicAuth(p.GetAPIKey(ctx), "")
 
 	res, err := planetHTTP().Do(r.WithContext(ctx))
 	if res == nil {
-		return nil, fmt.Errorf("http: %v", err)
+		return nil, transportError(err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(res.Body)
-		return nil, fmt.Errorf("api %s: %v", res.Status, buf.String())
+		return nil, fmt.Errorf("api: %w", newAPIError(res))
 	}
 
 	dec := json.NewDecoder(res.Body)
 	resp := &Response{}
 	if err := dec.Decode(resp); err != nil {
-		return nil, fmt.Errorf("api decode: %v")
+		return nil, fmt.Errorf("%w: api decode: %v", ErrUpstream, err)
 	}
 	return resp, nil
 }
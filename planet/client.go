@@ -2,8 +2,11 @@ package planet
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"planet-server/util"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,18 +30,154 @@ func planetHTTP() *retryablehttp.Client {
 		}
 		client.RetryMax = 15
 		client.ErrorHandler = retryablehttp.PassthroughErrorHandler
+		client.CheckRetry = checkRetry
+		client.Backoff = backoff
+		client.HTTPClient.Transport = &quotaTransport{base: client.HTTPClient.Transport}
 	})
 	return client
 }
 
+type noRetryKey struct{}
+
+// WithoutRetries makes requests using ctx give up after their first attempt,
+// for callers that must bound the number of upstream requests they make.
+func WithoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// checkRetry follows the default policy, but gives up on a rate limited
+// request when Planet asks us to wait past the request deadline, on requests
+// refused by our own quota, and on requests made WithoutRetries.
+func checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	var qe *quotaError
+	if errors.As(err, &qe) || ctx.Value(noRetryKey{}) != nil {
+		return false, nil
+	}
+	retry, err := retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	if !retry || resp == nil {
+		return retry, err
+	}
+	if wait := retryAfter(resp); wait > 0 {
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return false, nil
+		}
+	}
+	return retry, err
+}
+
+// backoff waits as long as a Retry-After header asks, otherwise backing off
+// exponentially.
+func backoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait := retryAfter(resp); wait > 0 {
+			return wait
+		}
+	}
+	return retryablehttp.DefaultBackoff(min, max, attempt, resp)
+}
+
+const (
+	DefaultAPIURL   = "https://api.planet.com/data/v1"
+	DefaultTileHost = "https://tiles%d.planet.com"
+
+	DefaultPageSize = 250
+	DefaultMaxPages = 10
+	DefaultMaxItems = 2000
+)
+
+// Options configures the upstream endpoints used by the client. Zero values
+// fall back to the public Planet service.
+type Options struct {
+	// Base URL of the data API, e.g. https://api.planet.com/data/v1
+	APIURL string
+	// Host serving XYZ tiles. May contain a single %d which is replaced with a
+	// random shard number in [0, 4).
+	TileHost string
+	// Host serving item thumbnails, with the same %d semantics as TileHost.
+	ThumbHost string
+
+	// Number of search results requested per page.
+	PageSize int
+	// Item types that may be searched and fetched. All of them are searched
+	// when a request does not name any.
+	ItemTypes []string
+
+	// Limits on the number of pages and results fetched by QuickSearchAll.
+	// Negative values disable the limit.
+	MaxPages int
+	MaxItems int
+
+	// Number of upstream scene tiles cached in memory. Negative disables the
+	// cache, though concurrent fetches of the same tile are still shared.
+	SceneCacheSize int
+
+	// Upstream requests per second for each endpoint class. Negative values
+	// disable the limit.
+	SearchRate float64
+	TileRate   float64
+	ThumbRate  float64
+
+	// Maximum upstream calls per UTC day and month across all classes. Zero
+	// means no limit.
+	DailyBudget   int64
+	MonthlyBudget int64
+}
+
+func (o *Options) setDefaults() {
+	if o.APIURL == "" {
+		o.APIURL = DefaultAPIURL
+	}
+	if o.TileHost == "" {
+		o.TileHost = DefaultTileHost
+	}
+	if o.ThumbHost == "" {
+		o.ThumbHost = o.TileHost
+	}
+	if len(o.ItemTypes) == 0 {
+		o.ItemTypes = DefaultItemTypes
+	}
+	if o.PageSize == 0 {
+		o.PageSize = DefaultPageSize
+	}
+	if o.MaxPages == 0 {
+		o.MaxPages = DefaultMaxPages
+	}
+	if o.MaxItems == 0 {
+		o.MaxItems = DefaultMaxItems
+	}
+	if o.SceneCacheSize == 0 {
+		o.SceneCacheSize = DefaultSceneCacheSize
+	}
+	if o.SearchRate == 0 {
+		o.SearchRate = DefaultSearchRate
+	}
+	if o.TileRate == 0 {
+		o.TileRate = DefaultTileRate
+	}
+	if o.ThumbRate == 0 {
+		o.ThumbRate = DefaultThumbRate
+	}
+	o.APIURL = strings.TrimSuffix(o.APIURL, "/")
+	o.TileHost = strings.TrimSuffix(o.TileHost, "/")
+	o.ThumbHost = strings.TrimSuffix(o.ThumbHost, "/")
+}
+
 type Client struct {
 	APIKey string
 	lock   sync.Mutex
+
+	opts   Options
+	scenes *sceneCache
+	quota  *quota
 }
 
-func New(ctx context.Context) *Client {
+func New(ctx context.Context, opts Options) *Client {
+	opts.setDefaults()
 	cl := &Client{
 		APIKey: util.EnvOrDefault("PLANET_API_KEY", ""),
+		opts:   opts,
+		scenes: newSceneCache(opts.SceneCacheSize),
+		quota:  newQuota(&opts),
 	}
 	go cl.GetAPIKey(ctx) // warm up key
 	return cl
@@ -48,6 +187,39 @@ type AppSettings struct {
 	PlanetAPIKey string `datastore:"planet_api_key"`
 }
 
+// ItemTypes returns the configured item types.
+func (p *Client) ItemTypes() []string {
+	return p.opts.ItemTypes
+}
+
+// ParseItemTypes parses a comma separated list of item types, checking that
+// each is configured. Entries are trimmed and blank ones ignored; an empty
+// list selects all configured item types.
+func (p *Client) ParseItemTypes(v string) ([]string, error) {
+	list := util.SplitList(v)
+	if len(list) == 0 {
+		return p.opts.ItemTypes, nil
+	}
+	var types []string
+	for _, t := range list {
+		if err := p.CheckItemType(t); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// CheckItemType returns an error if the item type is not configured.
+func (p *Client) CheckItemType(t string) error {
+	for _, c := range p.opts.ItemTypes {
+		if t == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported item type %q", t)
+}
+
 func (p *Client) GetAPIKey(pctx context.Context) string {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -0,0 +1,36 @@
+package planet_test
+
+import (
+	"context"
+	"planet-server/planet"
+	"reflect"
+	"testing"
+)
+
+func TestParseItemTypes(t *testing.T) {
+	t.Setenv("PLANET_API_KEY", "test")
+	pl := planet.New(context.Background(), planet.Options{ItemTypes: []string{"PSScene", "SkySatScene"}})
+
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{"PSScene", "SkySatScene"}, false},
+		{"PSScene", []string{"PSScene"}, false},
+		{"PSScene, SkySatScene", []string{"PSScene", "SkySatScene"}, false},
+		{"SkySatScene,", []string{"SkySatScene"}, false},
+		{" , ", []string{"PSScene", "SkySatScene"}, false},
+		{"PSScene,Landsat8L1G", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := pl.ParseItemTypes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseItemTypes(%q) error = %v", tt.in, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseItemTypes(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
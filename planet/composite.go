@@ -0,0 +1,128 @@
+package planet
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Composite selects how the scene tiles of a mosaic are merged.
+type Composite string
+
+const (
+	// Draw scenes over each other, highest priority on top.
+	CompositeOver Composite = "over"
+	// Pick each pixel from the highest priority scene that has usable data
+	// there, skipping transparent and likely-cloud pixels.
+	CompositeBest Composite = "best"
+)
+
+var (
+	// Pixels at least this bright with at most this saturation are assumed to
+	// be cloud by CompositeBest.
+	CloudBrightness = uint8(210)
+	CloudSaturation = 0.15
+)
+
+func ParseComposite(v string) (Composite, error) {
+	switch c := Composite(v); c {
+	case "":
+		return CompositeOver, nil
+	case CompositeOver, CompositeBest:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown composite mode %q", v)
+}
+
+func checkBounds(imgs []image.Image) (image.Rectangle, error) {
+	if len(imgs) == 0 {
+		panic("expected images")
+	}
+	b := imgs[0].Bounds()
+	for _, img := range imgs[1:] {
+		if img.Bounds() != b {
+			return b, fmt.Errorf("Bounds mismatch, %v vs %v", b, img.Bounds())
+		}
+	}
+	return b, nil
+}
+
+// compositeOver merges images in reverse order so the highest priority images
+// overlap the rest.
+func compositeOver(imgs []image.Image) (image.Image, error) {
+	b, err := checkBounds(imgs)
+	if err != nil {
+		return nil, err
+	}
+	out := image.NewRGBA(b)
+	for i := len(imgs) - 1; i >= 0; i-- {
+		draw.Draw(out, b, imgs[i], b.Min, draw.Over)
+	}
+	return out, nil
+}
+
+// likelyCloud is a cheap per-pixel cloud heuristic: clouds are bright and
+// nearly colorless.
+func likelyCloud(c color.NRGBA) bool {
+	max, min := c.R, c.R
+	for _, v := range []uint8{c.G, c.B} {
+		if v > max {
+			max = v
+		}
+		if v < min {
+			min = v
+		}
+	}
+	if max < CloudBrightness {
+		return false
+	}
+	return float64(max-min)/float64(max) <= CloudSaturation
+}
+
+// compositeBest picks each pixel from the first image with an opaque,
+// cloud-free pixel. If every opaque candidate looks like cloud the first of
+// those is used, and partially transparent pixels are only used when nothing
+// else has data.
+func compositeBest(imgs []image.Image) (image.Image, error) {
+	b, err := checkBounds(imgs)
+	if err != nil {
+		return nil, err
+	}
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var cloud, partial *color.NRGBA
+			var best *color.NRGBA
+			for _, img := range imgs {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if c.A == 0 {
+					continue // nodata
+				}
+				if c.A < 255 {
+					if partial == nil {
+						partial = &c
+					}
+					continue
+				}
+				if likelyCloud(c) {
+					if cloud == nil {
+						cloud = &c
+					}
+					continue
+				}
+				best = &c
+				break
+			}
+			switch {
+			case best != nil:
+				out.SetNRGBA(x, y, *best)
+			case cloud != nil:
+				out.SetNRGBA(x, y, *cloud)
+			case partial != nil:
+				out.SetNRGBA(x, y, *partial)
+			}
+		}
+	}
+	return out, nil
+}
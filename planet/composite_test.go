@@ -0,0 +1,80 @@
+package planet
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	nodata  = color.NRGBA{}
+	green   = color.NRGBA{40, 120, 50, 255}
+	red     = color.NRGBA{150, 40, 30, 255}
+	white   = color.NRGBA{240, 240, 235, 255}
+	grey    = color.NRGBA{220, 220, 220, 255}
+	partial = color.NRGBA{40, 120, 50, 128}
+)
+
+func pixel(c color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, c)
+	return img
+}
+
+func TestCompositeBest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []color.NRGBA
+		want color.NRGBA
+	}{
+		{"first clear", []color.NRGBA{green, red}, green},
+		{"skip transparent", []color.NRGBA{nodata, red}, red},
+		{"skip cloud", []color.NRGBA{white, red}, red},
+		{"cloud when nothing clear", []color.NRGBA{nodata, white, grey}, white},
+		{"cloud before partial", []color.NRGBA{partial, grey}, grey},
+		{"clear before partial", []color.NRGBA{partial, white, red}, red},
+		{"partial as last resort", []color.NRGBA{nodata, partial}, partial},
+		{"no data", []color.NRGBA{nodata, nodata}, nodata},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var imgs []image.Image
+			for _, c := range tt.in {
+				imgs = append(imgs, pixel(c))
+			}
+			out, err := compositeBest(imgs)
+			if err != nil {
+				t.Fatalf("compositeBest: %v", err)
+			}
+			if got := out.(*image.NRGBA).NRGBAAt(0, 0); got != tt.want {
+				t.Errorf("pixel = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLikelyCloud(t *testing.T) {
+	for _, tt := range []struct {
+		c    color.NRGBA
+		want bool
+	}{
+		{white, true},
+		{grey, true},
+		{green, false},
+		// Bright but saturated, e.g. sand or a roof.
+		{color.NRGBA{250, 210, 120, 255}, false},
+		// Colorless but too dark.
+		{color.NRGBA{120, 120, 120, 255}, false},
+	} {
+		if got := likelyCloud(tt.c); got != tt.want {
+			t.Errorf("likelyCloud(%v) = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestCompositeBestBoundsMismatch(t *testing.T) {
+	big := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	if _, err := compositeBest([]image.Image{pixel(green), big}); err == nil {
+		t.Errorf("compositeBest accepted images of different sizes")
+	}
+}
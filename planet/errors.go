@@ -0,0 +1,166 @@
+package planet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Classes of upstream failure. Errors returned by the client wrap one of
+// these, so callers can test them with errors.Is.
+var (
+	ErrRateLimited  = errors.New("rate limited by planet")
+	ErrUnauthorized = errors.New("planet rejected the API key")
+	ErrNotFound     = errors.New("not found at planet")
+	ErrUpstream     = errors.New("planet request failed")
+)
+
+// Limit on how much of an error response body is read.
+const maxErrorBody = 64 << 10
+
+// APIError is a non-200 response from a Planet endpoint.
+type APIError struct {
+	// One of the Err* classes above.
+	Kind   error
+	Status int
+	// Message from Planet's error JSON, or the raw body if it had none.
+	Message string
+	// Delay requested by a Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v (%d)", e.Kind, e.Status)
+	}
+	return fmt.Sprintf("%v (%d): %s", e.Kind, e.Status, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Kind
+}
+
+// errorBody covers the error formats used by the Planet APIs.
+type errorBody struct {
+	Message string `json:"message"`
+	General []struct {
+		Message string `json:"message"`
+	} `json:"general"`
+	Errors []string `json:"errors"`
+}
+
+func (b *errorBody) message() string {
+	msgs := []string{}
+	if b.Message != "" {
+		msgs = append(msgs, b.Message)
+	}
+	for _, g := range b.General {
+		if g.Message != "" {
+			msgs = append(msgs, g.Message)
+		}
+	}
+	msgs = append(msgs, b.Errors...)
+	return strings.Join(msgs, "; ")
+}
+
+// newAPIError reads an error response into an APIError.
+func newAPIError(res *http.Response) *APIError {
+	e := &APIError{
+		Status:     res.StatusCode,
+		RetryAfter: retryAfter(res),
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		e.Kind = ErrUnauthorized
+	case res.StatusCode == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	default:
+		e.Kind = ErrUpstream
+	}
+
+	raw, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	var body errorBody
+	if err := json.Unmarshal(raw, &body); err == nil {
+		e.Message = body.message()
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(raw))
+	}
+	return e
+}
+
+// transportError wraps a failure to get any response from Planet. Requests
+// refused by the quota never reached Planet, so they are returned as is.
+func transportError(err error) error {
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		return qe.err
+	}
+	return fmt.Errorf("%w: %v", ErrUpstream, err)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(res *http.Response) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// StatusCode maps an error from the client to the HTTP status to return to
+// our own clients.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrBudgetExhausted):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// RetryAfterOf returns the delay requested by Planet for a rate limited
+// error, or zero.
+func RetryAfterOf(err error) time.Duration {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// SetRetryAfter passes on the delay requested by Planet for a rate limited
+// error to our own client, rounded up to whole seconds.
+func SetRetryAfter(w http.ResponseWriter, err error) {
+	if d := RetryAfterOf(err); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	}
+}
@@ -0,0 +1,9 @@
+package planet
+
+import "time"
+
+// SetRetryWait shortens the backoff between retries so tests run quickly.
+func SetRetryWait(d time.Duration) {
+	c := planetHTTP()
+	c.RetryWaitMin, c.RetryWaitMax = d, d
+}
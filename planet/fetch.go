@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"image"
-	"image/draw"
 	"image/png"
 	"io"
 	"math/rand"
@@ -21,28 +20,46 @@ const (
 	TileSize = 256
 )
 
-func (p *Client) fetchTile(ctx context.Context, ID string, t maptile.Tile) (image.Image, error) {
+// shardHost expands the optional %d shard placeholder in a host template.
+func shardHost(tmpl string) string {
 	// TODO: domain selection could be improved to use some actual load balancing
 	// or fallback mechanism.
-	url := fmt.Sprintf("https://tiles%d.planet.com/data/v1/%s/%s/%d/%d/%d.png?api_key=%s", rand.Intn(4), ProductType, ID, t.Z, t.X, t.Y, p.GetAPIKey(ctx))
+	if strings.Contains(tmpl, "%d") {
+		return fmt.Sprintf(tmpl, rand.Intn(4))
+	}
+	return tmpl
+}
+
+// fetchTile returns a scene tile, from the scene cache when possible.
+func (p *Client) fetchTile(ctx context.Context, item Item, t maptile.Tile) (image.Image, error) {
+	return p.scenes.get(ctx, sceneKey{Item: item, Tile: t}, func(ctx context.Context) (image.Image, error) {
+		return p.downloadTile(ctx, item, t)
+	})
+}
+
+func (p *Client) downloadTile(ctx context.Context, item Item, t maptile.Tile) (image.Image, error) {
+	ctx = withQuota(ctx, p.quota, ClassTile)
+	url := fmt.Sprintf("%s/data/v1/%s/%s/%d/%d/%d.png?api_key=%s", shardHost(p.opts.TileHost), item.Type, item.ID, t.Z, t.X, t.Y, p.GetAPIKey(ctx))
 
-	log.Debugf("Fetching tile %q", ID)
+	log.Debugf("Fetching tile %q", item.ID)
 	req, err := retryablehttp.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	res, err := planetHTTP().Do(req.WithContext(ctx))
 	if res == nil {
-		return nil, fmt.Errorf("http: %v", err)
+		return nil, transportError(err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		buf := new(strings.Builder)
-		io.Copy(buf, res.Body)
-		return nil, fmt.Errorf("tile %v: %q", res.Status, buf.String())
+		return nil, fmt.Errorf("tile: %w", newAPIError(res))
 	}
 
-	return png.Decode(res.Body)
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: tile decode: %v", ErrUpstream, err)
+	}
+	return img, nil
 }
 
 type imageAndID struct {
@@ -57,82 +74,80 @@ func blankImage() image.Image {
 	})
 }
 
-// FetchTiles downloads tiles from the planet tile server to cover the provided tile. All the IDs provided are unioned.
-func (p *Client) FetchTiles(pctx context.Context, IDs []string, t maptile.Tile) (image.Image, error) {
-	if len(IDs) == 0 {
-		return blankImage(), nil
+// FetchTiles downloads tiles from the planet tile server to cover the provided tile. All the items provided are unioned.
+// Items are in priority order; earlier items are preferred by the composite mode.
+//
+// Scenes that fail to download are left out of the composite and returned as
+// failed. An error is returned only if every scene failed.
+func (p *Client) FetchTiles(pctx context.Context, items []Item, t maptile.Tile, mode Composite) (image.Image, []Item, error) {
+	if len(items) == 0 {
+		return blankImage(), nil, nil
 	}
 	ctx, cancel := context.WithDeadline(pctx, time.Now().Add(15*time.Second))
 	defer cancel()
 
-	var gerr error
-	var l sync.Mutex
-	m := make(map[string]image.Image)
+	imgs := make([]image.Image, len(items))
+	errs := make([]error, len(items))
 	wg := &sync.WaitGroup{}
 
 	// Fetch all images in parallel
-	for _, ID := range IDs {
+	for i, item := range items {
 		wg.Add(1)
-		go func(id string) {
+		go func(i int, item Item) {
 			defer wg.Done()
-			img, err := p.fetchTile(ctx, id, t)
-			l.Lock()
-			defer l.Unlock()
-			if err != nil && gerr == nil {
-				gerr = fmt.Errorf("%v: fetching tile %q", err, id)
-				cancel()
-				return
-			}
-			m[id] = img
-		}(ID)
+			imgs[i], errs[i] = p.fetchTile(ctx, item, t)
+		}(i, item)
 	}
 	wg.Wait()
-	if gerr != nil {
-		return nil, gerr
-	}
 
-	var out *image.RGBA
-	// Merge in reverse order. IDs will always be newest to oldest and we want
-	// to overlap newest images on top.
-	for i := len(IDs) - 1; i >= 0; i-- {
-		img, ok := m[IDs[i]]
-		if !ok {
-			panic("expected ID in result")
-		}
-		if out == nil {
-			out = image.NewRGBA(img.Bounds())
-		}
-		if out.Bounds() != img.Bounds() {
-			return nil, fmt.Errorf("Bounds mismatch, %v vs %v", out.Bounds(), img.Bounds())
+	var ok []image.Image
+	var failed []Item
+	var ferr error
+	for i, item := range items {
+		if errs[i] != nil {
+			log.Warnf("Tile %q failed: %v", item.ID, errs[i])
+			failed = append(failed, item)
+			if ferr == nil {
+				ferr = fmt.Errorf("%w: fetching tile %q", errs[i], item.ID)
+			}
+			continue
 		}
-		draw.Draw(out, img.Bounds(), img, image.Point{0, 0}, draw.Over)
+		ok = append(ok, imgs[i])
+	}
+	if len(ok) == 0 {
+		return nil, failed, ferr
 	}
-	if out == nil {
-		panic("expected IDs")
+
+	var img image.Image
+	var err error
+	switch mode {
+	case CompositeBest:
+		img, err = compositeBest(ok)
+	default:
+		img, err = compositeOver(ok)
 	}
-	return out, nil
+	return img, failed, err
 }
 
-func (p *Client) FetchThumb(pctx context.Context, ID string, w io.Writer) error {
+func (p *Client) FetchThumb(pctx context.Context, item Item, w io.Writer) error {
 	ctx, cancel := context.WithDeadline(pctx, time.Now().Add(15*time.Second))
 	defer cancel()
 
-	url := fmt.Sprintf("https://tiles%d.planet.com/data/v1/item-types/%s/items/%s/thumb?api_key=%s", rand.Intn(4), ProductType, ID, p.GetAPIKey(ctx))
+	ctx = withQuota(ctx, p.quota, ClassThumb)
+	url := fmt.Sprintf("%s/data/v1/item-types/%s/items/%s/thumb?api_key=%s", shardHost(p.opts.ThumbHost), item.Type, item.ID, p.GetAPIKey(ctx))
 
-	log.Debugf("Fetching thumb %q", ID)
+	log.Debugf("Fetching thumb %q", item.ID)
 	req, err := retryablehttp.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 	res, err := planetHTTP().Do(req.WithContext(ctx))
 	if res == nil {
-		return fmt.Errorf("http: %v", err)
+		return transportError(err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		buf := new(strings.Builder)
-		io.Copy(buf, res.Body)
-		return fmt.Errorf("thumb %v: %q", res.Status, buf.String())
+		return fmt.Errorf("thumb: %w", newAPIError(res))
 	}
 
 	if _, err := io.Copy(w, res.Body); err != nil {
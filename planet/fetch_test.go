@@ -0,0 +1,34 @@
+package planet_test
+
+import (
+	"context"
+	"planet-server/planet"
+	"planet-server/planet/planettest"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestConcurrentFetchTilesShareUpstream(t *testing.T) {
+	s, pl, f := newClient(t, nil)
+	tile := maptile.At(orb.Point{-122.33, 47.61}, 12)
+
+	const n = 8
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, failed, err := pl.FetchTiles(context.Background(), []planet.Item{f.Item()}, tile, planet.CompositeOver)
+			if err != nil || len(failed) > 0 {
+				t.Errorf("FetchTiles: %v, failed %v", err, failed)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.Requests(planettest.TileEndpoint); got != 1 {
+		t.Errorf("%d upstream tile requests, want 1", got)
+	}
+}
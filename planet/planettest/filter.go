@@ -0,0 +1,149 @@
+package planettest
+
+import (
+	"encoding/json"
+	"fmt"
+	"planet-server/planet"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// properties flattens a feature into the field names used by search filters.
+func properties(f *planet.Feature) (map[string]interface{}, error) {
+	j, err := json.Marshal(f.Properties)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(j, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// matches evaluates a decoded search filter against a feature. Only the
+// filter types used by the planet package are supported.
+func matches(filter map[string]interface{}, f *planet.Feature) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	field, _ := filter["field_name"].(string)
+
+	switch filter["type"] {
+	case "AndFilter", "OrFilter":
+		children, _ := filter["config"].([]interface{})
+		for _, c := range children {
+			cm, ok := c.(map[string]interface{})
+			if !ok {
+				return false, fmt.Errorf("bad filter config %v", c)
+			}
+			ok, err := matches(cm, f)
+			if err != nil {
+				return false, err
+			}
+			if filter["type"] == "AndFilter" && !ok {
+				return false, nil
+			}
+			if filter["type"] == "OrFilter" && ok {
+				return true, nil
+			}
+		}
+		// Every child matched an AndFilter, or none matched an OrFilter.
+		return filter["type"] == "AndFilter", nil
+
+	case "GeometryFilter":
+		j, err := json.Marshal(filter["config"])
+		if err != nil {
+			return false, err
+		}
+		g, err := geojson.UnmarshalGeometry(j)
+		if err != nil {
+			return false, fmt.Errorf("bad geometry: %v", err)
+		}
+		return g.Geometry().Bound().Intersects(f.Geometry.Geometry().Bound()), nil
+
+	case "DateRangeFilter":
+		props, err := properties(f)
+		if err != nil {
+			return false, err
+		}
+		v, _ := props[field].(string)
+		ts, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return false, fmt.Errorf("field %q: %v", field, err)
+		}
+		config, _ := filter["config"].(map[string]interface{})
+		for op, raw := range config {
+			s, _ := raw.(string)
+			bound, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return false, fmt.Errorf("bad date %q: %v", s, err)
+			}
+			if !compare(op, float64(ts.UnixNano()), float64(bound.UnixNano())) {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "RangeFilter":
+		props, err := properties(f)
+		if err != nil {
+			return false, err
+		}
+		v, _ := props[field].(float64)
+		config, _ := filter["config"].(map[string]interface{})
+		for op, raw := range config {
+			bound, _ := raw.(float64)
+			if !compare(op, v, bound) {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "StringInFilter":
+		props, err := properties(f)
+		if err != nil {
+			return false, err
+		}
+		v := fmt.Sprint(props[field])
+		if field == "id" {
+			v = f.ID
+		}
+		values, _ := filter["config"].([]interface{})
+		for _, want := range values {
+			if fmt.Sprint(want) == v {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported filter type %v", filter["type"])
+}
+
+func compare(op string, v, bound float64) bool {
+	switch op {
+	case "gt":
+		return v > bound
+	case "gte":
+		return v >= bound
+	case "lt":
+		return v < bound
+	case "lte":
+		return v <= bound
+	}
+	return false
+}
+
+// sortFeatures orders features by acquisition time, as the real API does.
+func sortFeatures(features []*planet.Feature, order string) {
+	asc := order == "acquired asc"
+	sort.SliceStable(features, func(i, j int) bool {
+		ti, tj := features[i].Properties.Acquired, features[j].Properties.Acquired
+		if asc {
+			return ti.Before(tj)
+		}
+		return ti.After(tj)
+	})
+}
@@ -0,0 +1,361 @@
+// Package planettest provides an in-process fake of the Planet data and tile
+// APIs for hermetic testing.
+package planettest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"planet-server/planet"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// DefaultPageSize is the number of search results per page when the request
+// does not specify _page_size.
+const DefaultPageSize = 250
+
+// Endpoint identifies a class of fake API endpoints for fault injection.
+type Endpoint int
+
+const (
+	AnyEndpoint Endpoint = iota
+	SearchEndpoint
+	TileEndpoint
+	ThumbEndpoint
+)
+
+// Fault describes a failure to inject into responses from the fake server.
+type Fault struct {
+	// Endpoint class the fault applies to.
+	Endpoint Endpoint
+	// HTTP status to return instead of the real response. Zero means the
+	// request is served normally (useful with Delay).
+	Status int
+	// Value of the Retry-After header, if non-empty.
+	RetryAfter string
+	// Delay before responding.
+	Delay time.Duration
+	// Number of requests affected. Zero or negative means all requests until
+	// the fault is cleared.
+	Count int
+}
+
+// Server is a fake Planet API. Use Options to point a planet.Client at it.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	features []*planet.Feature
+	faults   []*Fault
+	requests map[Endpoint]int
+
+	// Result sets of previous searches, for serving subsequent pages.
+	searches map[string][]*planet.Feature
+	nextID   int
+}
+
+// NewServer starts a fake Planet API server. The caller must call Close.
+func NewServer() *Server {
+	s := &Server{
+		requests: make(map[Endpoint]int),
+		searches: make(map[string][]*planet.Feature),
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/data/v1/quick-search", s.serveSearch).Methods("POST")
+	router.HandleFunc("/data/v1/searches/{search}/results", s.servePage).Methods("GET")
+	router.HandleFunc("/data/v1/item-types/{type}/items/{id}/thumb", s.serveThumb).Methods("GET")
+	router.HandleFunc("/data/v1/{type}/{id}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", s.serveTile).Methods("GET")
+
+	s.Server = httptest.NewServer(router)
+	return s
+}
+
+// Options returns client options that direct all API traffic to this server.
+func (s *Server) Options() planet.Options {
+	return planet.Options{
+		APIURL:    s.URL + "/data/v1",
+		TileHost:  s.URL,
+		ThumbHost: s.URL,
+	}
+}
+
+// AddFeatures adds canned features to be returned by quick-search.
+func (s *Server) AddFeatures(features ...*planet.Feature) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = append(s.features, features...)
+}
+
+// Inject adds a fault. Faults are applied in the order they were injected.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all pending faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the number of requests received for an endpoint class.
+func (s *Server) Requests(e Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e == AnyEndpoint {
+		total := 0
+		for _, n := range s.requests {
+			total += n
+		}
+		return total
+	}
+	return s.requests[e]
+}
+
+// NewFeature builds a PSScene feature with a rectangular footprint.
+func NewFeature(ID string, bound orb.Bound, acquired time.Time, satellite string) *planet.Feature {
+	return NewFeatureWithGeometry(ID, bound.ToPolygon(), acquired, satellite)
+}
+
+// NewFeatureWithGeometry builds a PSScene feature with an arbitrary footprint,
+// e.g. a MultiPolygon for scenes split across the antimeridian.
+func NewFeatureWithGeometry(ID string, g orb.Geometry, acquired time.Time, satellite string) *planet.Feature {
+	return &planet.Feature{
+		ID:       ID,
+		Geometry: geojson.NewGeometry(g),
+		Properties: &planet.Properties{
+			Acquired:       acquired,
+			Published:      acquired,
+			SatelliteID:    satellite,
+			ItemType:       planet.PSScene,
+			ClearPercent:   100,
+			VisiblePercent: 100,
+		},
+	}
+}
+
+// fault records the request and returns the fault to apply, if any.
+func (s *Server) fault(e Endpoint) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[e]++
+	for i, f := range s.faults {
+		if f.Endpoint != AnyEndpoint && f.Endpoint != e {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// applyFault injects the fault for an endpoint. Returns true if the response
+// has already been written.
+func (s *Server) applyFault(w http.ResponseWriter, r *http.Request, e Endpoint) bool {
+	f := s.fault(e)
+	if f == nil {
+		return false
+	}
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if f.Status == 0 {
+		return false
+	}
+	if f.RetryAfter != "" {
+		w.Header().Set("Retry-After", f.RetryAfter)
+	}
+	writeError(w, f.Status, http.StatusText(f.Status))
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if s.applyFault(w, r, SearchEndpoint) {
+		return
+	}
+
+	var req struct {
+		Filter    map[string]interface{} `json:"filter"`
+		ItemTypes []string               `json:"item_types"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	features := make([]*planet.Feature, len(s.features))
+	copy(features, s.features)
+	s.mu.Unlock()
+
+	resp := &planet.Response{Features: []*planet.Feature{}}
+	for _, f := range features {
+		if !hasItemType(req.ItemTypes, f.Properties.ItemType) {
+			continue
+		}
+		ok, err := matches(req.Filter, f)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ok {
+			resp.Features = append(resp.Features, f)
+		}
+	}
+	sortFeatures(resp.Features, r.URL.Query().Get("_sort"))
+
+	s.mu.Lock()
+	s.nextID++
+	search := strconv.Itoa(s.nextID)
+	s.searches[search] = resp.Features
+	s.mu.Unlock()
+
+	s.writePage(w, r, search, 0)
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request) {
+	if s.applyFault(w, r, SearchEndpoint) {
+		return
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("_page"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("bad _page: %v", err))
+		return
+	}
+	s.writePage(w, r, mux.Vars(r)["search"], page)
+}
+
+// writePage writes one page of a stored search result, honoring _page_size
+// and linking to the next page like the real API.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, search string, page int) {
+	s.mu.Lock()
+	features, ok := s.searches[search]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("search %q not found", search))
+		return
+	}
+
+	size := DefaultPageSize
+	if v := r.URL.Query().Get("_page_size"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bad _page_size %q", v))
+			return
+		}
+	}
+
+	start := page * size
+	if start > len(features) {
+		start = len(features)
+	}
+	end := start + size
+	if end > len(features) {
+		end = len(features)
+	}
+
+	resp := &planet.Response{Features: features[start:end]}
+	if end < len(features) {
+		resp.Links = &planet.Links{
+			Next: fmt.Sprintf("%s/data/v1/searches/%s/results?_page=%d&_page_size=%d", s.URL, search, page+1, size),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func hasItemType(types []string, t string) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// known returns whether a feature has been registered.
+func (s *Server) known(item planet.Item) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.features {
+		if f.Item() == item {
+			return true
+		}
+	}
+	return false
+}
+
+// ColorFor derives a stable, opaque color from a scene ID so composites can be
+// checked for which scene supplied each pixel.
+func ColorFor(ID string) color.RGBA {
+	h := fnv.New32a()
+	h.Write([]byte(ID))
+	v := h.Sum32()
+	return color.RGBA{R: uint8(v), G: uint8(v >> 8), B: uint8(v >> 16), A: 255}
+}
+
+func writePNG(w http.ResponseWriter, size int, c color.Color) {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, img)
+}
+
+func (s *Server) serveTile(w http.ResponseWriter, r *http.Request) {
+	if s.applyFault(w, r, TileEndpoint) {
+		return
+	}
+	vars := mux.Vars(r)
+	ID := vars["id"]
+	if !s.known(planet.Item{Type: vars["type"], ID: ID}) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("item %q not found", ID))
+		return
+	}
+	writePNG(w, planet.TileSize, ColorFor(ID))
+}
+
+func (s *Server) serveThumb(w http.ResponseWriter, r *http.Request) {
+	if s.applyFault(w, r, ThumbEndpoint) {
+		return
+	}
+	vars := mux.Vars(r)
+	ID := vars["id"]
+	if !s.known(planet.Item{Type: vars["type"], ID: ID}) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("item %q not found", ID))
+		return
+	}
+	writePNG(w, 256, ColorFor(ID))
+}
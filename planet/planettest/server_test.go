@@ -0,0 +1,168 @@
+package planettest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"planet-server/planet"
+	"planet-server/planet/planettest"
+	"planet-server/tileserver"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+var (
+	seattle  = orb.Point{-122.33, 47.61}
+	acquired = time.Date(2022, 6, 1, 18, 0, 0, 0, time.UTC)
+)
+
+// newClient starts a fake server and a client pointed at it.
+func newClient(t *testing.T, opts func(*planet.Options)) (*planettest.Server, *planet.Client) {
+	t.Helper()
+	// A key in the environment keeps the client away from datastore.
+	t.Setenv("PLANET_API_KEY", "test")
+	t.Setenv("TZ", "UTC")
+
+	s := planettest.NewServer()
+	t.Cleanup(s.Close)
+	o := s.Options()
+	if opts != nil {
+		opts(&o)
+	}
+	return s, planet.New(context.Background(), o)
+}
+
+func TestDateMosaicTile(t *testing.T) {
+	s, pl := newClient(t, nil)
+	tile := maptile.At(seattle, 12)
+	s.AddFeatures(
+		planettest.NewFeature("scene_on_date", tile.Bound().Pad(0.1), acquired, "sat1"),
+		planettest.NewFeature("scene_day_before", tile.Bound().Pad(0.1), acquired.Add(-24*time.Hour), "sat1"),
+	)
+
+	router := mux.NewRouter()
+	router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}.{ext:png|jpg|jpeg|webp}", tileserver.New(pl))
+	rec := httptest.NewRecorder()
+	url := fmt.Sprintf("/api/tile/%d/%d/%d.png?date=2022-06-01", tile.Z, tile.X, tile.Y)
+	router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, rec.Code)
+	}
+	if rec.Header().Get(tileserver.DegradedHeader) != "" {
+		t.Errorf("tile degraded: %q", rec.Header().Get(tileserver.DegradedHeader))
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode tile: %v", err)
+	}
+	want := planettest.ColorFor("scene_on_date")
+	r, g, b, a := img.At(128, 128).RGBA()
+	if uint8(r>>8) != want.R || uint8(g>>8) != want.G || uint8(b>>8) != want.B || a>>8 != 255 {
+		t.Errorf("pixel = %v, %v, %v, %v; want %v", r>>8, g>>8, b>>8, a>>8, want)
+	}
+	if n := s.Requests(planettest.SearchEndpoint); n != 1 {
+		t.Errorf("search requests = %d, want 1", n)
+	}
+	if n := s.Requests(planettest.TileEndpoint); n != 1 {
+		t.Errorf("tile requests = %d, want 1", n)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	s, pl := newClient(t, func(o *planet.Options) { o.PageSize = 2 })
+	bound := maptile.At(seattle, 12).Bound()
+	for i := 0; i < 5; i++ {
+		s.AddFeatures(planettest.NewFeature(fmt.Sprintf("scene%d", i), bound, acquired.Add(time.Duration(i)*time.Minute), "sat1"))
+	}
+	// Outside the searched region, so filtered out.
+	s.AddFeatures(planettest.NewFeature("far_away", orb.Bound{Min: orb.Point{10, 10}, Max: orb.Point{10.1, 10.1}}, acquired, "sat1"))
+
+	req := planet.RequestRegionOnDate(bound, time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), pl.ItemTypes())
+	resp, err := pl.QuickSearchAll(context.Background(), req)
+	if err != nil {
+		t.Fatalf("QuickSearchAll: %v", err)
+	}
+	ids := map[string]bool{}
+	for _, f := range resp.Features {
+		ids[f.ID] = true
+	}
+	for i := 0; i < 5; i++ {
+		if id := fmt.Sprintf("scene%d", i); !ids[id] {
+			t.Errorf("missing %s in results", id)
+		}
+	}
+	if ids["far_away"] {
+		t.Errorf("far_away returned for a region it does not intersect")
+	}
+	// Five matches at two per page.
+	if n := s.Requests(planettest.SearchEndpoint); n != 3 {
+		t.Errorf("search requests = %d, want 3", n)
+	}
+}
+
+func TestInjectedNotFound(t *testing.T) {
+	s, pl := newClient(t, nil)
+	f := planettest.NewFeature("scene", maptile.At(seattle, 12).Bound(), acquired, "sat1")
+	s.AddFeatures(f)
+	s.Inject(planettest.Fault{Endpoint: planettest.ThumbEndpoint, Status: http.StatusNotFound, Count: 1})
+
+	err := pl.FetchThumb(context.Background(), f.Item(), new(bytes.Buffer))
+	if !errors.Is(err, planet.ErrNotFound) {
+		t.Fatalf("FetchThumb error = %v, want ErrNotFound", err)
+	}
+	if got := planet.StatusCode(err); got != http.StatusNotFound {
+		t.Errorf("StatusCode = %d, want 404", got)
+	}
+
+	// The fault applied only once.
+	buf := new(bytes.Buffer)
+	if err := pl.FetchThumb(context.Background(), f.Item(), buf); err != nil {
+		t.Fatalf("FetchThumb after fault: %v", err)
+	}
+	if _, err := png.Decode(buf); err != nil {
+		t.Errorf("decode thumb: %v", err)
+	}
+	if n := s.Requests(planettest.ThumbEndpoint); n != 2 {
+		t.Errorf("thumb requests = %d, want 2", n)
+	}
+}
+
+func TestInjectedRateLimit(t *testing.T) {
+	s, pl := newClient(t, nil)
+	bound := maptile.At(seattle, 12).Bound()
+	s.AddFeatures(planettest.NewFeature("scene", bound, acquired, "sat1"))
+	s.Inject(planettest.Fault{Endpoint: planettest.SearchEndpoint, Status: http.StatusTooManyRequests, RetryAfter: "30"})
+
+	// Retry-After is past the deadline, so the client gives up at once.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := planet.RequestRegionOnDate(bound, time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), pl.ItemTypes())
+	_, err := pl.QuickSearch(ctx, req)
+	if !errors.Is(err, planet.ErrRateLimited) {
+		t.Fatalf("QuickSearch error = %v, want ErrRateLimited", err)
+	}
+	if got := planet.RetryAfterOf(err); got != 30*time.Second {
+		t.Errorf("RetryAfterOf = %v, want 30s", got)
+	}
+	if n := s.Requests(planettest.SearchEndpoint); n != 1 {
+		t.Errorf("search requests = %d, want 1", n)
+	}
+
+	s.ClearFaults()
+	resp, err := pl.QuickSearch(ctx, req)
+	if err != nil {
+		t.Fatalf("QuickSearch after clearing faults: %v", err)
+	}
+	if len(resp.Features) != 1 {
+		t.Errorf("got %d features, want 1", len(resp.Features))
+	}
+}
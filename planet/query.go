@@ -1,13 +1,21 @@
 package planet
 
 import (
+	"fmt"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 )
 
-func RequestRegion(bound orb.Bound, start, end time.Time) *Request {
+func RequestRegion(bound orb.Bound, start, end time.Time, itemTypes []string) *Request {
+	return RequestGeometry(bound.ToPolygon(), start, end, itemTypes)
+}
+
+// RequestGeometry searches for scenes intersecting an arbitrary geometry.
+func RequestGeometry(g orb.Geometry, start, end time.Time, itemTypes []string) *Request {
 	return &Request{
 		Filter: &AndFilter{
 			Type: "AndFilter",
@@ -23,22 +31,22 @@ func RequestRegion(bound orb.Bound, start, end time.Time) *Request {
 				&GeoFilter{
 					Type:      "GeometryFilter",
 					FieldName: "geometry",
-					Config:    geojson.NewGeometry(bound.ToPolygon()),
+					Config:    geojson.NewGeometry(g),
 				},
 			},
 		},
-		ItemTypes: []string{ProductType},
+		ItemTypes: itemTypes,
 	}
 }
 
-func RequestRegionOnDate(bound orb.Bound, d time.Time) *Request {
-	return RequestRegion(bound, d, d.Add(24*time.Hour))
+func RequestRegionOnDate(bound orb.Bound, d time.Time, itemTypes []string) *Request {
+	return RequestRegion(bound, d, d.Add(24*time.Hour), itemTypes)
 }
 
-func RequestRegionForSatellite(bound orb.Bound, d time.Time, satellite string) *Request {
+func RequestRegionForSatellite(bound orb.Bound, d time.Time, satellite string, itemTypes []string) *Request {
 	start := d.Add(-15 * time.Minute)
 	end := d.Add(15 * time.Minute)
-	req := RequestRegion(bound, start, end)
+	req := RequestRegion(bound, start, end, itemTypes)
 	af := req.Filter.(*AndFilter)
 	af.Config = append(af.Config, interface{}(&StringInFilter{
 		Type:      "StringInFilter",
@@ -47,3 +55,82 @@ func RequestRegionForSatellite(bound orb.Bound, d time.Time, satellite string) *
 	}))
 	return req
 }
+
+// Quality bounds the cloud and clear percentages of matching scenes. Nil
+// fields are unbounded.
+type Quality struct {
+	MaxCloud *int `json:",omitempty"`
+	MinClear *int `json:",omitempty"`
+}
+
+func percentRange(min, max *int) *Range {
+	toFloat := func(v *int) *float64 {
+		if v == nil {
+			return nil
+		}
+		f := float64(*v)
+		return &f
+	}
+	return &Range{Min: toFloat(min), Max: toFloat(max)}
+}
+
+// Apply adds range filters for the quality bounds to a request.
+func (q Quality) Apply(req *Request) {
+	af := req.Filter.(*AndFilter)
+	if q.MaxCloud != nil {
+		af.Config = append(af.Config, interface{}(&RangeFilter{
+			Type:      "RangeFilter",
+			FieldName: "cloud_percent",
+			Config:    percentRange(nil, q.MaxCloud),
+		}))
+	}
+	if q.MinClear != nil {
+		af.Config = append(af.Config, interface{}(&RangeFilter{
+			Type:      "RangeFilter",
+			FieldName: "clear_percent",
+			Config:    percentRange(q.MinClear, nil),
+		}))
+	}
+}
+
+// Values encodes the quality bounds as the query parameters read by
+// ParseQuality.
+func (q Quality) Values() url.Values {
+	v := make(url.Values)
+	if q.MaxCloud != nil {
+		v.Set("max_cloud", strconv.Itoa(*q.MaxCloud))
+	}
+	if q.MinClear != nil {
+		v.Set("min_clear", strconv.Itoa(*q.MinClear))
+	}
+	return v
+}
+
+func parsePercent(form url.Values, key string) (*int, error) {
+	s := form.Get(key)
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %v", key, err)
+	}
+	if v < 0 || v > 100 {
+		return nil, fmt.Errorf("bad %s: %d not in [0, 100]", key, v)
+	}
+	return &v, nil
+}
+
+// ParseQuality reads the optional max_cloud and min_clear percentage
+// parameters from a request form.
+func ParseQuality(form url.Values) (Quality, error) {
+	var q Quality
+	var err error
+	if q.MaxCloud, err = parsePercent(form, "max_cloud"); err != nil {
+		return Quality{}, err
+	}
+	if q.MinClear, err = parsePercent(form, "min_clear"); err != nil {
+		return Quality{}, err
+	}
+	return q, nil
+}
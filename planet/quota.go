@@ -0,0 +1,203 @@
+package planet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Class groups upstream endpoints that share a rate limit.
+type Class string
+
+const (
+	ClassSearch Class = "search"
+	ClassTile   Class = "tile"
+	ClassThumb  Class = "thumb"
+)
+
+var classes = []Class{ClassSearch, ClassTile, ClassThumb}
+
+const (
+	// Default upstream request rates, per second.
+	DefaultSearchRate = 2
+	DefaultTileRate   = 50
+	DefaultThumbRate  = 10
+)
+
+var (
+	// ErrBudgetExhausted is returned instead of calling upstream once the
+	// configured daily or monthly budget has been used up.
+	ErrBudgetExhausted = errors.New("planet API budget exhausted")
+)
+
+// Usage counts upstream calls in the current UTC day and month.
+type Usage struct {
+	Day     string          `json:"day"`
+	Month   string          `json:"month"`
+	Daily   map[Class]int64 `json:"daily"`
+	Monthly map[Class]int64 `json:"monthly"`
+
+	DailyBudget   int64 `json:"daily_budget,omitempty"`
+	MonthlyBudget int64 `json:"monthly_budget,omitempty"`
+}
+
+func total(m map[Class]int64) int64 {
+	var n int64
+	for _, v := range m {
+		n += v
+	}
+	return n
+}
+
+// quota rate limits upstream calls and accounts for them.
+type quota struct {
+	limiters map[Class]*rate.Limiter
+
+	mu    sync.Mutex
+	usage Usage
+}
+
+func newQuota(o *Options) *quota {
+	q := &quota{
+		limiters: make(map[Class]*rate.Limiter),
+		usage: Usage{
+			DailyBudget:   o.DailyBudget,
+			MonthlyBudget: o.MonthlyBudget,
+		},
+	}
+	for c, r := range map[Class]float64{
+		ClassSearch: o.SearchRate,
+		ClassTile:   o.TileRate,
+		ClassThumb:  o.ThumbRate,
+	} {
+		if r < 0 {
+			q.limiters[c] = rate.NewLimiter(rate.Inf, 0)
+		} else {
+			// Allow a second's worth of requests in a burst.
+			q.limiters[c] = rate.NewLimiter(rate.Limit(r), int(r)+1)
+		}
+	}
+	q.roll(time.Now())
+	return q
+}
+
+// roll resets the counters when the day or month changes. Must be called
+// with the lock held.
+func (q *quota) roll(now time.Time) {
+	now = now.UTC()
+	if m := now.Format("2006-01"); m != q.usage.Month {
+		q.usage.Month = m
+		q.usage.Monthly = make(map[Class]int64)
+	}
+	if d := now.Format("2006-01-02"); d != q.usage.Day {
+		q.usage.Day = d
+		q.usage.Daily = make(map[Class]int64)
+	}
+}
+
+// take waits for the rate limit of class and records the call, or fails if
+// the budget is exhausted.
+func (q *quota) take(ctx context.Context, c Class) error {
+	if err := q.check(); err != nil {
+		return err
+	}
+	if err := q.limiters[c].Wait(ctx); err != nil {
+		return fmt.Errorf("%s rate limit: %w", c, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Checked again as the budget may have run out while waiting.
+	if err := q.checkLocked(); err != nil {
+		return err
+	}
+	q.usage.Daily[c]++
+	q.usage.Monthly[c]++
+	return nil
+}
+
+type quotaKey struct{}
+
+type quotaClass struct {
+	q *quota
+	c Class
+}
+
+// withQuota makes every upstream attempt of requests using ctx, including
+// retries, wait for the rate limit of class and count against the budget.
+func withQuota(ctx context.Context, q *quota, c Class) context.Context {
+	return context.WithValue(ctx, quotaKey{}, quotaClass{q, c})
+}
+
+// quotaError is a request refused by the quota before reaching upstream.
+type quotaError struct {
+	err error
+}
+
+func (e *quotaError) Error() string { return e.err.Error() }
+func (e *quotaError) Unwrap() error { return e.err }
+
+// quotaTransport applies the quota attached by withQuota to each attempt.
+type quotaTransport struct {
+	base http.RoundTripper
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if qc, ok := req.Context().Value(quotaKey{}).(quotaClass); ok {
+		if err := qc.q.take(req.Context(), qc.c); err != nil {
+			return nil, &quotaError{err}
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (q *quota) check() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.checkLocked()
+}
+
+func (q *quota) checkLocked() error {
+	q.roll(time.Now())
+	u := &q.usage
+	if u.DailyBudget > 0 && total(u.Daily) >= u.DailyBudget {
+		return fmt.Errorf("%w: %d calls used today", ErrBudgetExhausted, u.DailyBudget)
+	}
+	if u.MonthlyBudget > 0 && total(u.Monthly) >= u.MonthlyBudget {
+		return fmt.Errorf("%w: %d calls used this month", ErrBudgetExhausted, u.MonthlyBudget)
+	}
+	return nil
+}
+
+func (q *quota) snapshot() Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(time.Now())
+	u := q.usage
+	u.Daily = make(map[Class]int64)
+	u.Monthly = make(map[Class]int64)
+	for _, c := range classes {
+		u.Daily[c] = q.usage.Daily[c]
+		u.Monthly[c] = q.usage.Monthly[c]
+	}
+	return u
+}
+
+// Usage returns the upstream calls made so far today and this month.
+func (p *Client) Usage() Usage {
+	return p.quota.snapshot()
+}
+
+func (p *Client) ServeUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.Usage()); err != nil {
+		log.Debugf("usage encode failed: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package planet_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"planet-server/planet"
+	"planet-server/planet/planettest"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+func newClient(t *testing.T, opts func(*planet.Options)) (*planettest.Server, *planet.Client, *planet.Feature) {
+	t.Helper()
+	t.Setenv("PLANET_API_KEY", "test")
+	planet.SetRetryWait(time.Millisecond)
+
+	s := planettest.NewServer()
+	t.Cleanup(s.Close)
+	f := planettest.NewFeature("scene", maptile.At(orb.Point{-122.33, 47.61}, 12).Bound(), time.Now(), "sat1")
+	s.AddFeatures(f)
+	o := s.Options()
+	if opts != nil {
+		opts(&o)
+	}
+	return s, planet.New(context.Background(), o), f
+}
+
+func TestRetriesCounted(t *testing.T) {
+	s, pl, f := newClient(t, nil)
+	s.Inject(planettest.Fault{Endpoint: planettest.ThumbEndpoint, Status: http.StatusInternalServerError, Count: 3})
+
+	if err := pl.FetchThumb(context.Background(), f.Item(), new(bytes.Buffer)); err != nil {
+		t.Fatalf("FetchThumb: %v", err)
+	}
+	if n := s.Requests(planettest.ThumbEndpoint); n != 4 {
+		t.Errorf("thumb requests = %d, want 4", n)
+	}
+	if n := pl.Usage().Daily[planet.ClassThumb]; n != 4 {
+		t.Errorf("daily thumb usage = %d, want 4", n)
+	}
+}
+
+func TestBudgetStopsRetries(t *testing.T) {
+	s, pl, f := newClient(t, func(o *planet.Options) { o.DailyBudget = 3 })
+	s.Inject(planettest.Fault{Endpoint: planettest.ThumbEndpoint, Status: http.StatusInternalServerError})
+
+	err := pl.FetchThumb(context.Background(), f.Item(), new(bytes.Buffer))
+	if !errors.Is(err, planet.ErrBudgetExhausted) {
+		t.Fatalf("FetchThumb error = %v, want ErrBudgetExhausted", err)
+	}
+	if got := planet.StatusCode(err); got != http.StatusServiceUnavailable {
+		t.Errorf("StatusCode = %d, want 503", got)
+	}
+	if n := s.Requests(planettest.ThumbEndpoint); n != 3 {
+		t.Errorf("thumb requests = %d, want 3", n)
+	}
+
+	// Later calls fail without reaching upstream.
+	s.ClearFaults()
+	if err := pl.FetchThumb(context.Background(), f.Item(), new(bytes.Buffer)); !errors.Is(err, planet.ErrBudgetExhausted) {
+		t.Errorf("FetchThumb error = %v, want ErrBudgetExhausted", err)
+	}
+	if n := s.Requests(planettest.ThumbEndpoint); n != 3 {
+		t.Errorf("thumb requests = %d, want 3", n)
+	}
+}
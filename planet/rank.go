@@ -0,0 +1,69 @@
+package planet
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// SortOrder selects how scenes are prioritized when compositing a mosaic.
+type SortOrder string
+
+const (
+	// Most recently acquired first. This matches the API result order.
+	SortNewest SortOrder = "newest"
+	// Highest clear_percent first.
+	SortClear SortOrder = "clear"
+	// Lowest cloud_percent first.
+	SortCloud SortOrder = "cloud"
+	// Acquisition time closest to a target time first.
+	SortTime SortOrder = "time"
+	// Most nadir (smallest view_angle) first.
+	SortViewAngle SortOrder = "view_angle"
+)
+
+func ParseSortOrder(v string) (SortOrder, error) {
+	switch o := SortOrder(v); o {
+	case "":
+		return SortNewest, nil
+	case SortNewest, SortClear, SortCloud, SortTime, SortViewAngle:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown sort order %q", v)
+}
+
+// Ranking orders features by priority, best first.
+type Ranking struct {
+	Order SortOrder
+	// Reference time for SortTime.
+	Target time.Time
+}
+
+func (r Ranking) less(a, b *Feature) bool {
+	pa, pb := a.Properties, b.Properties
+	switch r.Order {
+	case SortClear:
+		return pa.ClearPercent > pb.ClearPercent
+	case SortCloud:
+		return pa.CloudPercent < pb.CloudPercent
+	case SortTime:
+		da := math.Abs(float64(pa.Acquired.Sub(r.Target)))
+		db := math.Abs(float64(pb.Acquired.Sub(r.Target)))
+		return da < db
+	case SortViewAngle:
+		return math.Abs(pa.ViewAngle) < math.Abs(pb.ViewAngle)
+	}
+	return pa.Acquired.After(pb.Acquired)
+}
+
+// Sort returns a copy of the features ordered by the ranking. Ties keep their
+// original relative order.
+func (r Ranking) Sort(features []*Feature) []*Feature {
+	out := make([]*Feature, len(features))
+	copy(out, features)
+	sort.SliceStable(out, func(i, j int) bool {
+		return r.less(out[i], out[j])
+	})
+	return out
+}
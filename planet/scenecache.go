@@ -0,0 +1,97 @@
+package planet
+
+import (
+	"container/list"
+	"context"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	// Default number of upstream scene tiles kept in memory, about 64MB of
+	// decoded RGBA.
+	DefaultSceneCacheSize = 256
+
+	sceneFetchTimeout = 15 * time.Second
+)
+
+type sceneKey struct {
+	Item Item
+	Tile maptile.Tile
+}
+
+type sceneEntry struct {
+	key sceneKey
+	// Closed once the fetch completes.
+	done chan struct{}
+	img  image.Image
+	err  error
+	// Position in the LRU, set once the fetch succeeded.
+	elem *list.Element
+}
+
+// sceneCache keeps recently fetched scene tiles and shares in-flight fetches
+// between concurrent requests for the same scene tile.
+type sceneCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[sceneKey]*sceneEntry
+	// Completed entries, most recently used first.
+	lru *list.List
+}
+
+func newSceneCache(size int) *sceneCache {
+	return &sceneCache{
+		size:    size,
+		entries: make(map[sceneKey]*sceneEntry),
+		lru:     list.New(),
+	}
+}
+
+// get returns the tile for key, calling fetch at most once for concurrent
+// callers. The fetch is detached from any one caller so that a cancelled
+// request does not fail the others waiting on it. Failures are not cached.
+func (c *sceneCache) get(ctx context.Context, key sceneKey, fetch func(context.Context) (image.Image, error)) (image.Image, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+	} else {
+		e = &sceneEntry{key: key, done: make(chan struct{})}
+		c.entries[key] = e
+		go c.run(e, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return e.img, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *sceneCache) run(e *sceneEntry, fetch func(context.Context) (image.Image, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), sceneFetchTimeout)
+	defer cancel()
+	e.img, e.err = fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.err != nil || c.size <= 0 {
+		delete(c.entries, e.key)
+	} else {
+		e.elem = c.lru.PushFront(e)
+		for c.lru.Len() > c.size {
+			old := c.lru.Remove(c.lru.Back()).(*sceneEntry)
+			delete(c.entries, old.key)
+		}
+	}
+	close(e.done)
+}
@@ -0,0 +1,178 @@
+package planet
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func key(x uint32) sceneKey {
+	return sceneKey{Item: Item{Type: PSScene, ID: "scene"}, Tile: maptile.New(x, 0, 12)}
+}
+
+// counter is a fetch that counts its calls, optionally blocking until
+// released.
+type counter struct {
+	calls   int32
+	release chan struct{}
+	err     error
+}
+
+func (c *counter) fetch(ctx context.Context) (image.Image, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if c.release != nil {
+		select {
+		case <-c.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return image.NewRGBA(image.Rect(0, 0, TileSize, TileSize)), nil
+}
+
+func (c *counter) count() int {
+	return int(atomic.LoadInt32(&c.calls))
+}
+
+func TestSceneCacheSharesFetch(t *testing.T) {
+	c := newSceneCache(8)
+	f := &counter{release: make(chan struct{})}
+
+	const n = 8
+	imgs := make([]image.Image, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img, err := c.get(context.Background(), key(0), f.fetch)
+			if err != nil {
+				t.Errorf("get: %v", err)
+			}
+			imgs[i] = img
+		}(i)
+	}
+	// Let the callers join the fetch in flight. Any that arrive later are
+	// served from the cache, which must not fetch again either.
+	time.Sleep(10 * time.Millisecond)
+	close(f.release)
+	wg.Wait()
+
+	if f.count() != 1 {
+		t.Errorf("fetched %d times, want 1", f.count())
+	}
+	for i, img := range imgs {
+		if img != imgs[0] {
+			t.Errorf("request %d got a different image", i)
+		}
+	}
+}
+
+func TestSceneCacheCancelledCaller(t *testing.T) {
+	c := newSceneCache(8)
+	f := &counter{release: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := c.get(ctx, key(0), f.fetch)
+		cancelled <- err
+	}()
+	waiting := make(chan error)
+	go func() {
+		// Joins the fetch started by the first caller.
+		for f.count() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		_, err := c.get(context.Background(), key(0), f.fetch)
+		waiting <- err
+	}()
+	for f.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("cancelled get error = %v, want context.Canceled", err)
+	}
+	// The fetch outlives the cancelled caller.
+	close(f.release)
+	if err := <-waiting; err != nil {
+		t.Errorf("other caller failed: %v", err)
+	}
+	if f.count() != 1 {
+		t.Errorf("fetched %d times, want 1", f.count())
+	}
+}
+
+func TestSceneCacheFailuresNotCached(t *testing.T) {
+	c := newSceneCache(8)
+	failing := &counter{err: errors.New("upstream down")}
+	if _, err := c.get(context.Background(), key(0), failing.fetch); err == nil {
+		t.Fatalf("get succeeded with a failing fetch")
+	}
+
+	ok := &counter{}
+	if _, err := c.get(context.Background(), key(0), ok.fetch); err != nil {
+		t.Fatalf("get after a failure: %v", err)
+	}
+	if ok.count() != 1 {
+		t.Errorf("failure was cached, fetched %d times after it", ok.count())
+	}
+	// Successes are cached.
+	c.get(context.Background(), key(0), ok.fetch)
+	if ok.count() != 1 {
+		t.Errorf("fetched %d times, want 1", ok.count())
+	}
+}
+
+func TestSceneCacheBounded(t *testing.T) {
+	c := newSceneCache(2)
+	f := &counter{}
+	get := func(x uint32) {
+		t.Helper()
+		if _, err := c.get(context.Background(), key(x), f.fetch); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+
+	get(0)
+	get(1)
+	get(0) // Most recently used, so 1 is evicted next.
+	get(2)
+	if f.count() != 3 {
+		t.Fatalf("fetched %d times, want 3", f.count())
+	}
+	get(0)
+	if f.count() != 3 {
+		t.Errorf("recently used tile evicted")
+	}
+	get(1)
+	if f.count() != 4 {
+		t.Errorf("least recently used tile kept")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("cache holds %d entries, %d indexed; want 2", c.lru.Len(), len(c.entries))
+	}
+}
+
+func TestSceneCacheDisabled(t *testing.T) {
+	c := newSceneCache(-1)
+	f := &counter{}
+	c.get(context.Background(), key(0), f.fetch)
+	c.get(context.Background(), key(0), f.fetch)
+	if f.count() != 2 {
+		t.Errorf("fetched %d times with the cache disabled, want 2", f.count())
+	}
+}
@@ -6,10 +6,24 @@ import (
 	"github.com/paulmach/orb/geojson"
 )
 
+// Item types supported by the tile service.
 const (
-	ProductType = "PSScene4Band"
+	PSScene      = "PSScene"
+	PSScene4Band = "PSScene4Band" // Deprecated by Planet, use PSScene.
+	SkySatScene  = "SkySatScene"
+	REOrthoTile  = "REOrthoTile"
 )
 
+var (
+	DefaultItemTypes = []string{PSScene}
+)
+
+// Item identifies a single scene of a given item type.
+type Item struct {
+	Type string
+	ID   string
+}
+
 type GeoFilter struct {
 	Type      string            `json:"type"`
 	Config    *geojson.Geometry `json:"config"`
@@ -33,6 +47,17 @@ type DateRangeFilter struct {
 	Config    *DateRange `json:"config"`
 }
 
+type Range struct {
+	Min *float64 `json:"gte,omitempty"`
+	Max *float64 `json:"lte,omitempty"`
+}
+
+type RangeFilter struct {
+	Type      string `json:"type"`
+	FieldName string `json:"field_name"`
+	Config    *Range `json:"config"`
+}
+
 type AndFilter struct {
 	Type   string        `json:"type"`
 	Config []interface{} `json:"config"`
@@ -46,6 +71,8 @@ type Properties struct {
 	CloudPercent    int       `json:"cloud_percent"`
 	SatelliteID     string    `json:"satellite_id"`
 	PixelResolution int       `json:"pixel_resolution"`
+	ViewAngle       float64   `json:"view_angle"`
+	ItemType        string    `json:"item_type"`
 }
 
 type Feature struct {
@@ -54,11 +81,31 @@ type Feature struct {
 	Properties *Properties       `json:"properties"`
 }
 
+func (f *Feature) Item() Item {
+	return Item{Type: f.Properties.ItemType, ID: f.ID}
+}
+
 type Request struct {
 	Filter    interface{} `json:"filter"`
 	ItemTypes []string    `json:"item_types"`
 }
 
+type Links struct {
+	Next string `json:"_next"`
+}
+
+func (l *Links) next() string {
+	if l == nil {
+		return ""
+	}
+	return l.Next
+}
+
 type Response struct {
+	Links    *Links     `json:"_links,omitempty"`
 	Features []*Feature `json:"features"`
+
+	// Set by QuickSearchAll when results were cut short by the configured
+	// page or item limits.
+	Truncated bool `json:"-"`
 }
@@ -1,6 +1,7 @@
 package thumbserver
 
 import (
+	"bytes"
 	"net/http"
 	"planet-server/planet"
 
@@ -17,9 +18,29 @@ func New(p *planet.Client) *ThumbServer {
 }
 
 func (s *ThumbServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ID := mux.Vars(r)["id"]
-	w.Header().Set("Content-Type", "image/png")
-	if err := s.Client.FetchThumb(r.Context(), ID, w); err != nil {
+	r.ParseForm()
+	item := planet.Item{
+		Type: r.Form.Get("item_type"),
+		ID:   mux.Vars(r)["id"],
+	}
+	if item.Type == "" {
+		item.Type = s.Client.ItemTypes()[0]
+	}
+	if err := s.Client.CheckItemType(item.Type); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Buffered so failures, including an exhausted budget, are reported
+	// with a status rather than an empty image.
+	buf := new(bytes.Buffer)
+	if err := s.Client.FetchThumb(r.Context(), item, buf); err != nil {
 		log.Errorf("thumb proxy failed: %v", err)
+		planet.SetRetryAfter(w, err)
+		http.Error(w, err.Error(), planet.StatusCode(err))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Debugf("thumb write failed: %v", err)
 	}
 }
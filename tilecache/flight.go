@@ -0,0 +1,93 @@
+package tilecache
+
+import (
+	"context"
+	"planet-server/planet"
+
+	"github.com/paulmach/orb"
+)
+
+// SearchFunc runs an upstream search for a region.
+type SearchFunc func(ctx context.Context, region orb.Bound) ([]*planet.Feature, error)
+
+// flight is a search in progress, shared by every request whose bound lies
+// within its region. Guarded by the pool lock except where noted.
+type flight struct {
+	region  orb.Bound
+	waiters int
+	cancel  context.CancelFunc
+
+	// Closed when the search finishes; features and err are set before.
+	done     chan struct{}
+	features []*planet.Feature
+	err      error
+}
+
+// Do returns the features for bound from the cache, from a search already in
+// flight whose region contains bound, or by starting a search of region, which
+// should contain bound. Results of new searches are added to the cache.
+//
+// A search is cancelled once every request waiting on it has given up.
+func (c *TileCache) Do(ctx context.Context, bound, region orb.Bound, search SearchFunc) ([]*planet.Feature, error) {
+	c.mu.Lock()
+	if features, ok := c.get(bound); ok {
+		c.mu.Unlock()
+		return features, nil
+	}
+	var f *flight
+	for g := range c.flights {
+		if contains(g.region, bound) {
+			f = g
+			break
+		}
+	}
+	if f == nil {
+		// The search outlives any single request, so it is cancelled
+		// by reference count rather than by the caller's context.
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{
+			region: region,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		c.flights[f] = true
+		go c.run(fctx, f, search)
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.features, f.err
+	case <-ctx.Done():
+		c.leave(f)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops a waiter, cancelling the search if nobody else wants it.
+func (c *TileCache) leave(f *flight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.waiters--
+	if f.waiters == 0 && c.flights[f] {
+		// Unregister right away so new requests start a fresh search
+		// instead of joining a cancelled one.
+		delete(c.flights, f)
+		f.cancel()
+	}
+}
+
+func (c *TileCache) run(ctx context.Context, f *flight, search SearchFunc) {
+	defer f.cancel()
+	features, err := search(ctx, f.region)
+	if err == nil {
+		c.Put(f.region, features)
+	}
+
+	c.mu.Lock()
+	delete(c.flights, f)
+	f.features, f.err = features, err
+	c.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,182 @@
+package tilecache
+
+import (
+	"context"
+	"planet-server/planet"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waiters returns the number of requests waiting on searches in flight.
+func (c *TileCache) waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for f := range c.flights {
+		n += f.waiters
+	}
+	return n
+}
+
+func (c *TileCache) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.flights)
+}
+
+func TestDoSharesSearch(t *testing.T) {
+	c := New()
+	region := bound(0, 0, 10, 10)
+	release := make(chan struct{})
+	var calls int32
+	search := func(ctx context.Context, r orb.Bound) ([]*planet.Feature, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []*planet.Feature{feature("scene", t0)}, nil
+	}
+
+	const n = 8
+	results := make([][]*planet.Feature, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := bound(float64(i), float64(i), float64(i)+1, float64(i)+1)
+			features, err := c.Do(context.Background(), b, region, search)
+			if err != nil {
+				t.Errorf("Do: %v", err)
+			}
+			results[i] = features
+		}(i)
+	}
+	waitFor(t, "all requests to wait", func() bool { return c.waiters() == n })
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("searched %d times, want 1", calls)
+	}
+	for i, features := range results {
+		if len(features) != 1 || features[0].ID != "scene" {
+			t.Errorf("request %d got %v", i, features)
+		}
+	}
+	if n := c.inFlight(); n != 0 {
+		t.Errorf("%d searches still in flight", n)
+	}
+	// Later requests in the region are served from the cache.
+	if _, err := c.Do(context.Background(), bound(2, 2, 3, 3), region, search); err != nil {
+		t.Errorf("Do: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("searched %d times after a cached result, want 1", calls)
+	}
+}
+
+func TestDoCancelsAbandonedSearch(t *testing.T) {
+	c := New()
+	region := bound(0, 0, 10, 10)
+	cancelled := make(chan struct{})
+	blocking := func(ctx context.Context, r orb.Bound) ([]*planet.Feature, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	const n = 3
+	cancels := make([]context.CancelFunc, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		go func() {
+			_, err := c.Do(ctx, bound(1, 1, 2, 2), region, blocking)
+			errs <- err
+		}()
+	}
+	waitFor(t, "all requests to wait", func() bool { return c.waiters() == n })
+
+	// The search keeps running while anybody still waits on it.
+	for _, cancel := range cancels[:n-1] {
+		cancel()
+	}
+	for i := 0; i < n-1; i++ {
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("Do error = %v, want context.Canceled", err)
+		}
+	}
+	select {
+	case <-cancelled:
+		t.Fatalf("search cancelled with a request still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancels[n-1]()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Do error = %v, want context.Canceled", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("search not cancelled after every request gave up")
+	}
+
+	// A later request starts a fresh search rather than joining the
+	// cancelled one.
+	var calls int32
+	fresh := func(ctx context.Context, r orb.Bound) ([]*planet.Feature, error) {
+		atomic.AddInt32(&calls, 1)
+		return []*planet.Feature{feature("fresh", t0)}, ctx.Err()
+	}
+	features, err := c.Do(context.Background(), bound(1, 1, 2, 2), region, fresh)
+	if err != nil {
+		t.Fatalf("Do after cancel: %v", err)
+	}
+	if calls != 1 || len(features) != 1 || features[0].ID != "fresh" {
+		t.Errorf("got %v from %d searches, want a fresh search", features, calls)
+	}
+}
+
+func TestDoLeavesNoGoroutines(t *testing.T) {
+	c := New()
+	before := runtime.NumGoroutine()
+
+	search := func(ctx context.Context, r orb.Bound) ([]*planet.Feature, error) {
+		return []*planet.Feature{feature("scene", t0)}, nil
+	}
+	for i := 0; i < 10; i++ {
+		b := bound(float64(10*i), 0, float64(10*i+10), 10)
+		if _, err := c.Do(context.Background(), b, b, search); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+	failing := func(ctx context.Context, r orb.Bound) ([]*planet.Feature, error) {
+		return nil, context.DeadlineExceeded
+	}
+	if _, err := c.Do(context.Background(), bound(200, 0, 210, 10), bound(200, 0, 210, 10), failing); err == nil {
+		t.Fatalf("Do succeeded with a failing search")
+	}
+
+	waitFor(t, "search goroutines to exit", func() bool { return runtime.NumGoroutine() <= before })
+	if n := c.inFlight(); n != 0 {
+		t.Errorf("%d searches still in flight", n)
+	}
+}
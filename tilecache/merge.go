@@ -0,0 +1,80 @@
+package tilecache
+
+import (
+	"planet-server/planet"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+// edges returns the sorted distinct coordinates of the entry bounds along one
+// axis, clipped to [lo, hi].
+func edges(entries []*cachedData, lo, hi float64, axis int) []float64 {
+	vs := []float64{lo, hi}
+	for _, d := range entries {
+		for _, v := range []float64{d.Bound.Min[axis], d.Bound.Max[axis]} {
+			if v > lo && v < hi {
+				vs = append(vs, v)
+			}
+		}
+	}
+	sort.Float64s(vs)
+	out := vs[:1]
+	for _, v := range vs[1:] {
+		if v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// covers returns whether the union of the entry bounds contains bound. The
+// bound is split into a grid along every entry edge; it is covered if the
+// center of each grid cell lies within some entry.
+func covers(entries []*cachedData, bound orb.Bound) bool {
+	xs := edges(entries, bound.Min.X(), bound.Max.X(), 0)
+	ys := edges(entries, bound.Min.Y(), bound.Max.Y(), 1)
+	for i := 0; i+1 < len(xs); i++ {
+		for j := 0; j+1 < len(ys); j++ {
+			p := orb.Point{(xs[i] + xs[i+1]) / 2, (ys[j] + ys[j+1]) / 2}
+			hit := false
+			for _, d := range entries {
+				if d.Bound.Contains(p) {
+					hit = true
+					break
+				}
+			}
+			if !hit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// merge combines the features of several entries, newest entry first,
+// dropping duplicate IDs. The result is ordered newest acquisition first like
+// the search API.
+func merge(entries []*cachedData) []*planet.Feature {
+	sorted := make([]*cachedData, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Added.After(sorted[j].Added)
+	})
+
+	seen := make(map[string]bool)
+	var out []*planet.Feature
+	for _, d := range sorted {
+		for _, f := range d.Features {
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			out = append(out, f)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Properties.Acquired.After(out[j].Properties.Acquired)
+	})
+	return out
+}
@@ -0,0 +1,95 @@
+package tilecache
+
+import (
+	"planet-server/planet"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+var t0 = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func bound(x0, y0, x1, y1 float64) orb.Bound {
+	return orb.Bound{Min: orb.Point{x0, y0}, Max: orb.Point{x1, y1}}
+}
+
+func feature(ID string, acquired time.Time) *planet.Feature {
+	return &planet.Feature{ID: ID, Properties: &planet.Properties{Acquired: acquired}}
+}
+
+func entry(b orb.Bound, added time.Time, features ...*planet.Feature) *cachedData {
+	return &cachedData{Bound: b, Added: added, Features: features}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []orb.Bound
+		want    bool
+	}{
+		{"half overlapping", []orb.Bound{bound(0, 0, 6, 10), bound(4, 0, 10, 10)}, true},
+		{"touching halves", []orb.Bound{bound(0, 0, 5, 10), bound(5, 0, 10, 10)}, true},
+		{"gap between", []orb.Bound{bound(0, 0, 4, 10), bound(6, 0, 10, 10)}, false},
+		{"missing corner", []orb.Bound{bound(0, 0, 10, 5), bound(0, 5, 5, 10)}, false},
+		{"four quadrants", []orb.Bound{bound(-1, -1, 5, 5), bound(5, -1, 11, 5), bound(-1, 5, 5, 11), bound(5, 5, 11, 11)}, true},
+		{"short of the edge", []orb.Bound{bound(0, 0, 6, 10), bound(4, 0, 9.5, 10)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*cachedData
+			for _, b := range tt.entries {
+				entries = append(entries, entry(b, t0))
+			}
+			if got := covers(entries, bound(0, 0, 10, 10)); got != tt.want {
+				t.Errorf("covers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	older := feature("shared", t0.Add(time.Hour))
+	newer := feature("shared", t0.Add(time.Hour))
+	entries := []*cachedData{
+		entry(bound(0, 0, 6, 10), t0, feature("left", t0), older),
+		entry(bound(4, 0, 10, 10), t0.Add(time.Minute), newer, feature("right", t0.Add(2*time.Hour))),
+	}
+
+	got := merge(entries)
+	var ids []string
+	for _, f := range got {
+		ids = append(ids, f.ID)
+	}
+	want := []string{"right", "shared", "left"}
+	if len(ids) != len(want) {
+		t.Fatalf("merge = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("merge = %v, want %v", ids, want)
+		}
+	}
+	if got[1] != newer {
+		t.Errorf("shared feature taken from the older entry")
+	}
+}
+
+func TestGetMergesCoveringEntries(t *testing.T) {
+	c := New()
+	c.Put(bound(0, 0, 6, 10), []*planet.Feature{feature("left", t0), feature("shared", t0.Add(time.Hour))})
+	c.Put(bound(4, 0, 10, 10), []*planet.Feature{feature("shared", t0.Add(time.Hour)), feature("right", t0.Add(2*time.Hour))})
+
+	features, ok := c.Get(bound(1, 1, 9, 9))
+	if !ok {
+		t.Fatalf("Get missed a bound covered by two entries")
+	}
+	if len(features) != 3 {
+		t.Errorf("got %d features, want 3", len(features))
+	}
+
+	c.Put(bound(20, 0, 30, 10), nil)
+	if _, ok := c.Get(bound(1, 1, 25, 9)); ok {
+		t.Errorf("Get hit a bound with a gap between entries")
+	}
+}
@@ -1,20 +1,63 @@
 package tilecache
 
 import (
+	"container/list"
 	"encoding/json"
+	"planet-server/planet"
 	"sync"
+	"time"
 
+	"github.com/paulmach/orb"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	DefaultMaxEntries  = 5000
+	DefaultMaxBytes    = 256 << 20
+	DefaultIdleTimeout = 3 * CacheHistory
+
+	// Minimum time between sweeps for idle pools and expired entries.
+	SweepInterval = time.Minute
+)
+
+// Limits bounds the memory held by a MultiCache across all of its pools.
+// Zero values disable the corresponding limit.
+type Limits struct {
+	// Maximum number of cached search regions.
+	MaxEntries int
+	// Maximum estimated size of cached features, in bytes.
+	MaxBytes int64
+	// Pools not used for this long are dropped.
+	IdleTimeout time.Duration
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxEntries:  DefaultMaxEntries,
+		MaxBytes:    DefaultMaxBytes,
+		IdleTimeout: DefaultIdleTimeout,
+	}
+}
+
 type MultiCache struct {
+	// Limits may be changed before the cache is first used.
+	Limits Limits
+
 	m map[string]*TileCache
 	l sync.Mutex
+
+	// Entries of all pools, most recently used first.
+	lru       *list.List
+	bytes     int64
+	lastSweep time.Time
 }
 
 func NewMulti() *MultiCache {
 	return &MultiCache{
-		m: make(map[string]*TileCache),
+		Limits:    DefaultLimits(),
+		m:         make(map[string]*TileCache),
+		lru:       list.New(),
+		lastSweep: time.Now(),
 	}
 }
 
@@ -25,13 +68,141 @@ func (c *MultiCache) For(k interface{}) *TileCache {
 	}
 	key := string(j)
 	c.l.Lock()
-	defer c.l.Unlock()
+	pools := c.sweep()
 	r, ok := c.m[key]
-	if ok {
-		return r
+	if !ok {
+		log.Debugf("Building new cache pool for %v", key)
+		r = New()
+		r.owner = c
+		c.m[key] = r
+	}
+	r.lastUsed = time.Now()
+	c.l.Unlock()
+
+	// Expire entries outside of the multi cache lock, which must not be held
+	// while acquiring a pool lock.
+	for _, p := range pools {
+		p.mu.Lock()
+		p.expire()
+		p.mu.Unlock()
 	}
-	log.Debugf("Building new cache pool for %v", key)
-	r = New()
-	c.m[key] = r
 	return r
 }
+
+// sweep drops idle pools and returns the remaining pools for expiry, at most
+// once per SweepInterval. Must be called with the lock held.
+func (c *MultiCache) sweep() []*TileCache {
+	if time.Since(c.lastSweep) < SweepInterval {
+		return nil
+	}
+	c.lastSweep = time.Now()
+
+	var live []*TileCache
+	for key, p := range c.m {
+		if c.Limits.IdleTimeout > 0 && time.Since(p.lastUsed) > c.Limits.IdleTimeout {
+			log.Debugf("Dropping idle cache pool for %v", key)
+			p.dropped = true
+			delete(c.m, key)
+			continue
+		}
+		live = append(live, p)
+	}
+
+	// Stop accounting for entries of dropped pools; the pools themselves are
+	// garbage once in-flight requests finish with them.
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if d := e.Value.(*cachedData); d.pool.dropped {
+			c.unlink(d)
+		}
+		e = next
+	}
+	return live
+}
+
+func (c *MultiCache) unlink(d *cachedData) {
+	if d.elem == nil {
+		return
+	}
+	c.lru.Remove(d.elem)
+	d.elem = nil
+	c.bytes -= d.size
+}
+
+func (c *MultiCache) over() bool {
+	return (c.Limits.MaxEntries > 0 && c.lru.Len() > c.Limits.MaxEntries) ||
+		(c.Limits.MaxBytes > 0 && c.bytes > c.Limits.MaxBytes)
+}
+
+// add accounts for a new entry and returns the least recently used entries
+// that must be evicted to stay within limits.
+func (c *MultiCache) add(d *cachedData) []*cachedData {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if d.pool.dropped {
+		return nil
+	}
+	d.elem = c.lru.PushFront(d)
+	c.bytes += d.size
+
+	var victims []*cachedData
+	for c.over() {
+		v := c.lru.Back().Value.(*cachedData)
+		c.unlink(v)
+		victims = append(victims, v)
+	}
+	if len(victims) > 0 {
+		log.Debugf("Evicting %d cache entries, %d entries and %d bytes remain", len(victims), c.lru.Len(), c.bytes)
+	}
+	return victims
+}
+
+func (c *MultiCache) touch(ds ...*cachedData) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for _, d := range ds {
+		if d.elem != nil {
+			c.lru.MoveToFront(d.elem)
+		}
+	}
+}
+
+func (c *MultiCache) forget(d *cachedData) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.unlink(d)
+}
+
+// estimateSize roughly approximates the memory held by cached features.
+func estimateSize(features []*planet.Feature) int64 {
+	const (
+		perFeature = 512
+		perPoint   = 16
+	)
+	size := int64(0)
+	for _, f := range features {
+		size += perFeature
+		if f.Geometry != nil {
+			size += perPoint * int64(countPoints(f.Geometry.Geometry()))
+		}
+	}
+	return size
+}
+
+func countPoints(g orb.Geometry) int {
+	switch g := g.(type) {
+	case orb.Polygon:
+		n := 0
+		for _, r := range g {
+			n += len(r)
+		}
+		return n
+	case orb.MultiPolygon:
+		n := 0
+		for _, p := range g {
+			n += countPoints(p)
+		}
+		return n
+	}
+	return 1
+}
@@ -1,18 +1,37 @@
 package tilecache
 
 import (
+	"container/list"
 	"planet-server/planet"
+	"planet-server/util"
 	"sync"
 	"time"
 
 	"github.com/paulmach/orb"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/rtree"
 )
 
 type cachedData struct {
 	Features []*planet.Feature
 	Bound    orb.Bound
 	Added    time.Time
+
+	// Set once the entry has been dropped from the index.
+	removed bool
+
+	// Bookkeeping for the owning MultiCache, guarded by its lock.
+	pool *TileCache
+	elem *list.Element
+	size int64
+}
+
+func rect(b orb.Bound) (min, max [2]float64) {
+	return [2]float64{b.Min.X(), b.Min.Y()}, [2]float64{b.Max.X(), b.Max.Y()}
+}
+
+func contains(outer, inner orb.Bound) bool {
+	return outer.Contains(inner.Min) && outer.Contains(inner.Max)
 }
 
 const (
@@ -20,35 +39,97 @@ const (
 )
 
 type TileCache struct {
-	// TODO some more efficient data structure for this
-	//  - don't use O(N) lookup
-	//  - simplify bounds that are contained in others
-	cache []*cachedData
+	// Spatial index of live entries by bound.
+	index rtree.RTreeG[*cachedData]
+	// All entries in insertion order, used to expire them by age. Entries
+	// dropped from the index early stay here until they expire, without their
+	// features.
+	queue []*cachedData
 
-	watchers map[*TileWatcher]bool
+	// Searches in progress, see Do.
+	flights map[*flight]bool
 
 	mu sync.Mutex
+
+	// MultiCache that accounts for this pool's entries, if any.
+	owner *MultiCache
+	// Guarded by the owner's lock.
+	lastUsed time.Time
+	dropped  bool
 }
 
 func New() *TileCache {
 	return &TileCache{
-		watchers: make(map[*TileWatcher]bool),
+		flights: make(map[*flight]bool),
+	}
+}
+
+func (c *TileCache) remove(d *cachedData) {
+	if d.removed {
+		return
+	}
+	min, max := rect(d.Bound)
+	c.index.Delete(min, max, d)
+	d.removed = true
+	// Free the features now, the entry may linger in the queue.
+	d.Features = nil
+	if c.owner != nil {
+		c.owner.forget(d)
 	}
 }
 
+// evict removes an entry chosen for eviction by the owner.
+func (c *TileCache) evict(d *cachedData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(d)
+}
+
+// touch marks entries as recently used.
+func (c *TileCache) touch(ds ...*cachedData) {
+	if c.owner != nil {
+		c.owner.touch(ds...)
+	}
+}
+
+// expire drops entries older than CacheHistory.
+func (c *TileCache) expire() {
+	n := 0
+	for _, d := range c.queue {
+		if time.Since(d.Added) <= CacheHistory {
+			break
+		}
+		c.remove(d)
+		n++
+	}
+	c.queue = c.queue[n:]
+}
+
+// get returns the features for a bound, either from the newest entry that
+// contains it or merged from several entries that cover it together.
 func (c *TileCache) get(bound orb.Bound) ([]*planet.Feature, bool) {
-	trunc := 0
-	for i, d := range c.cache {
-		if time.Since(d.Added) > CacheHistory {
-			trunc = i + 1
-			continue
+	c.expire()
+	var best *cachedData
+	var overlapping []*cachedData
+	min, max := rect(bound)
+	c.index.Search(min, max, func(_, _ [2]float64, d *cachedData) bool {
+		if contains(d.Bound, bound) && (best == nil || d.Added.After(best.Added)) {
+			best = d
 		}
-		if d.Bound.Contains(bound.Min) && d.Bound.Contains(bound.Max) {
-			return d.Features, true
+		if util.Overlaps(d.Bound, bound) {
+			overlapping = append(overlapping, d)
 		}
+		return true
+	})
+	if best != nil {
+		c.touch(best)
+		return best.Features, true
 	}
-	c.cache = c.cache[trunc:]
-	return nil, false
+	if len(overlapping) < 2 || !covers(overlapping, bound) {
+		return nil, false
+	}
+	c.touch(overlapping...)
+	return merge(overlapping), true
 }
 
 func (c *TileCache) Get(bound orb.Bound) ([]*planet.Feature, bool) {
@@ -58,50 +139,46 @@ func (c *TileCache) Get(bound orb.Bound) ([]*planet.Feature, bool) {
 }
 
 func (c *TileCache) Put(bound orb.Bound, features []*planet.Feature) {
+	// Evicted entries may belong to other pools, so they are removed only
+	// after this pool's lock is released.
+	for _, d := range c.put(bound, features) {
+		d.pool.evict(d)
+	}
+}
+
+// put adds an entry, returning entries to be evicted to stay within the
+// owner's limits.
+func (c *TileCache) put(bound orb.Bound, features []*planet.Feature) []*cachedData {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.cache = append(c.cache, &cachedData{
+	c.expire()
+
+	// Older entries fully inside the new bound are redundant.
+	var covered []*cachedData
+	min, max := rect(bound)
+	c.index.Search(min, max, func(_, _ [2]float64, d *cachedData) bool {
+		if contains(bound, d.Bound) {
+			covered = append(covered, d)
+		}
+		return true
+	})
+	for _, d := range covered {
+		c.remove(d)
+	}
+
+	d := &cachedData{
 		Bound:    bound,
 		Features: features,
 		Added:    time.Now(),
-	})
-	log.Debugf("Tile cache has %d entries and %d watchers", len(c.cache), len(c.watchers))
-	for w, _ := range c.watchers {
-		if result, ok := c.get(w.bound); ok {
-			log.Debugf("notifying watcher of result")
-			w.C <- result
-			w.remove()
-		}
+		pool:     c,
+		size:     estimateSize(features),
 	}
-}
-
-type TileWatcher struct {
-	C chan []*planet.Feature
-
-	parent *TileCache
-	bound  orb.Bound
-}
-
-func (w *TileWatcher) remove() {
-	delete(w.parent.watchers, w)
-}
-
-func (w *TileWatcher) Close() {
-	w.parent.mu.Lock()
-	w.remove()
-	w.parent.mu.Unlock()
-	close(w.C)
-}
-
-func (c *TileCache) Watch(bound orb.Bound) *TileWatcher {
-	w := &TileWatcher{
-		C: make(chan []*planet.Feature),
-
-		parent: c,
-		bound:  bound,
+	c.index.Insert(min, max, d)
+	c.queue = append(c.queue, d)
+	var victims []*cachedData
+	if c.owner != nil {
+		victims = c.owner.add(d)
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.watchers[w] = true
-	return w
+	log.Debugf("Tile cache has %d entries and %d searches in flight", c.index.Len(), len(c.flights))
+	return victims
 }
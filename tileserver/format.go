@@ -0,0 +1,165 @@
+package tileserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Format is an image encoding for tiles, named by its file extension.
+type Format string
+
+const (
+	FormatPNG  Format = "png"
+	FormatJPEG Format = "jpg"
+	FormatWebP Format = "webp"
+)
+
+const (
+	DefaultJPEGQuality = 85
+	DefaultWebPQuality = 80
+)
+
+var (
+	ErrWebPUnsupported = errors.New("webp tiles are not supported by this server")
+)
+
+// output describes how a tile response is encoded.
+type output struct {
+	// Requested format, or empty to pick one per tile.
+	Format Format
+	// Whether the client accepts WebP, when picking per tile.
+	WebP bool
+	// Encoder quality from 1 to 100, or zero for the server default.
+	Quality int
+}
+
+// qualityFor returns the encoder quality used for a tile encoded as f.
+func (s *TileServer) qualityFor(o *output, f Format) int {
+	switch f {
+	case FormatJPEG:
+		if o.Quality == 0 {
+			return s.JPEGQuality
+		}
+	case FormatWebP:
+		if o.Quality == 0 {
+			return s.WebPQuality
+		}
+	default:
+		// PNG is lossless.
+		return 0
+	}
+	return o.Quality
+}
+
+// outputKey distinguishes encodings in cache keys and ETags, including the
+// quality actually used so changing the server defaults changes the key.
+func (s *TileServer) outputKey(o *output) string {
+	f := o.Format
+	if f == "" {
+		// Picked per tile; only WebP or JPEG can be lossy.
+		f = FormatJPEG
+		if o.WebP {
+			f = FormatWebP
+		}
+	}
+	return fmt.Sprintf("%s/%t/%d", o.Format, o.WebP, s.qualityFor(o, f))
+}
+
+// accepts reports whether an Accept header lists a media type.
+func accepts(header, mediaType string) bool {
+	for _, v := range strings.Split(header, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil || t != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// parseOutput reads the format from the route extension, negotiating it from
+// the Accept header when there is none, and the optional quality parameter.
+func parseOutput(r *http.Request) (*output, error) {
+	o := &output{}
+	switch ext := mux.Vars(r)["ext"]; ext {
+	case "":
+		o.WebP = webpSupported && accepts(r.Header.Get("Accept"), "image/webp")
+	case "png":
+		o.Format = FormatPNG
+	case "jpg", "jpeg":
+		o.Format = FormatJPEG
+	case "webp":
+		if !webpSupported {
+			return nil, ErrWebPUnsupported
+		}
+		o.Format = FormatWebP
+	default:
+		return nil, fmt.Errorf("unsupported tile format %q", ext)
+	}
+	if v := r.Form.Get("quality"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			return nil, fmt.Errorf("bad quality %q: must be 1 to 100", v)
+		}
+		o.Quality = q
+	}
+	return o, nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// encode renders img in the requested format. Without one it prefers WebP
+// when accepted, then JPEG for fully opaque tiles, keeping PNG for tiles
+// that need transparency.
+func (s *TileServer) encode(o *output, img image.Image) ([]byte, string, error) {
+	f := o.Format
+	if f == "" {
+		switch {
+		case o.WebP:
+			f = FormatWebP
+		case isOpaque(img):
+			f = FormatJPEG
+		default:
+			f = FormatPNG
+		}
+	}
+
+	switch f {
+	case FormatJPEG:
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: s.qualityFor(o, f)}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	case FormatWebP:
+		b, err := encodeWebP(img, s.qualityFor(o, f))
+		if err != nil {
+			return nil, "", err
+		}
+		return b, "image/webp", nil
+	default:
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+}
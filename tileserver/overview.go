@@ -0,0 +1,193 @@
+package tileserver
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"math"
+	"net/url"
+	"planet-server/planet"
+	"planet-server/util"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+	xdraw "golang.org/x/image/draw"
+
+	// Registered for decoding cached child tiles.
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Lowest zoom at which date mosaics are served as overviews.
+	OverviewMinZ = 6
+
+	// Default number of upstream calls allowed per overview tile.
+	DefaultOverviewBudget = 8
+)
+
+// overviewKey selects the search cache pool for overviews. Overview searches
+// fetch only the first page of results, so they must not be mixed with the
+// complete results used by regular mosaic tiles.
+type overviewKey struct {
+	Overview bool
+	Query    *mosaicQuery
+}
+
+// pixelOf returns the position of a point in the pixel space of a tile
+// rendered at the given size.
+func pixelOf(t maptile.Tile, size int, p orb.Point) (float64, float64) {
+	n := math.Exp2(float64(t.Z))
+	lat := p.Lat() * math.Pi / 180
+	x := (p.Lon() + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+	return (x - float64(t.X)) * float64(size), (y - float64(t.Y)) * float64(size)
+}
+
+// pixelRect returns the pixel area of a bound within a tile.
+func pixelRect(t maptile.Tile, size int, b orb.Bound) image.Rectangle {
+	x0, y0 := pixelOf(t, size, b.LeftTop())
+	x1, y1 := pixelOf(t, size, b.RightBottom())
+	return image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x1)), int(math.Ceil(y1)))
+}
+
+// cachedChildren returns the rendered children of a tile found in the disk
+// cache, in any format, indexed like Tile.Children.
+func (s *TileServer) cachedChildren(tq *tileQuery, o *output, form url.Values) []image.Image {
+	children := tq.Tile.Children()
+	imgs := make([]image.Image, len(children))
+	if s.Disk == nil {
+		return imgs
+	}
+	outputs := []*output{
+		o,
+		{Format: FormatPNG, Quality: o.Quality},
+		{Quality: o.Quality},
+		{WebP: true, Quality: o.Quality},
+		{Format: FormatJPEG, Quality: o.Quality},
+		{Format: FormatWebP, Quality: o.Quality},
+	}
+	for i, child := range children {
+		for _, co := range outputs {
+			_, _, data, ok := s.diskGet(s.tileDiskKey(child, 1, co, form))
+			if !ok {
+				continue
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				log.Warnf("Overview %v: bad cached child %v: %v", tq.Tile, child, err)
+				continue
+			}
+			imgs[i] = img
+			break
+		}
+	}
+	return imgs
+}
+
+// renderOverview builds a low zoom mosaic tile by downsampling whatever is
+// cheaply available: rendered children in the disk cache, topped up with
+// scene thumbnails for the rest. At most OverviewBudget upstream requests are
+// made, so the result may be incomplete.
+func (s *TileServer) renderOverview(ctx context.Context, tq *tileQuery, o *output, form url.Values) (image.Image, error) {
+	// Each fetch is a single upstream request, so the budget holds when
+	// Planet is failing.
+	ctx = planet.WithoutRetries(ctx)
+	size := TileSize * tq.Scale
+	out := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	children := tq.Tile.Children()
+	cached := s.cachedChildren(tq, o, form)
+	missing := 0
+	for _, img := range cached {
+		if img == nil {
+			missing++
+		}
+	}
+
+	budget := s.OverviewBudget
+	if missing > 0 && budget > 1 {
+		// One call for the search, the rest for thumbnails.
+		budget--
+		features, err := s.Cache.For(overviewKey{true, tq.Mosaic}).Do(ctx, tq.Tile.Bound(), tq.Tile.Bound(), func(ctx context.Context, region orb.Bound) ([]*planet.Feature, error) {
+			resp, err := s.Client.QuickSearch(ctx, tq.Mosaic.request(region))
+			if err != nil {
+				return nil, err
+			}
+			return resp.Features, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Only scenes over areas without a cached child are worth fetching.
+		var picked []*planet.Feature
+		for _, f := range tq.Rank.Sort(features) {
+			if len(picked) >= budget {
+				log.Debugf("Overview %v: budget exhausted, skipping remaining scenes", tq.Tile)
+				break
+			}
+			if f.Geometry == nil {
+				continue
+			}
+			b := f.Geometry.Geometry().Bound()
+			for i, child := range children {
+				if cached[i] == nil && util.Overlaps(b, child.Bound()) {
+					picked = append(picked, f)
+					break
+				}
+			}
+		}
+
+		thumbs := s.fetchThumbs(ctx, picked)
+		// Lowest ranked first, so better scenes end up on top.
+		for i := len(picked) - 1; i >= 0; i-- {
+			if thumbs[i] == nil {
+				continue
+			}
+			r := pixelRect(tq.Tile, size, picked[i].Geometry.Geometry().Bound())
+			xdraw.ApproxBiLinear.Scale(out, r, thumbs[i], thumbs[i].Bounds(), xdraw.Over, nil)
+		}
+	}
+
+	for i, child := range children {
+		if cached[i] == nil {
+			continue
+		}
+		half := size / 2
+		at := image.Pt(int(child.X-2*tq.Tile.X)*half, int(child.Y-2*tq.Tile.Y)*half)
+		r := image.Rectangle{Min: at, Max: at.Add(image.Pt(half, half))}
+		xdraw.ApproxBiLinear.Scale(out, r, cached[i], cached[i].Bounds(), xdraw.Src, nil)
+	}
+	return out, nil
+}
+
+// fetchThumbs downloads scene thumbnails in parallel. Failed thumbnails are
+// logged and left nil.
+func (s *TileServer) fetchThumbs(ctx context.Context, features []*planet.Feature) []image.Image {
+	imgs := make([]image.Image, len(features))
+	wg := &sync.WaitGroup{}
+	for i, f := range features {
+		wg.Add(1)
+		go func(i int, f *planet.Feature) {
+			defer wg.Done()
+			buf := new(bytes.Buffer)
+			if err := s.Client.FetchThumb(ctx, f.Item(), buf); err != nil {
+				log.Warnf("Overview thumb %q failed: %v", f.ID, err)
+				return
+			}
+			img, _, err := image.Decode(buf)
+			if err != nil {
+				log.Warnf("Overview thumb %q: %v", f.ID, err)
+				return
+			}
+			imgs[i] = img
+		}(i, f)
+	}
+	wg.Wait()
+	return imgs
+}
@@ -0,0 +1,63 @@
+package tileserver_test
+
+import (
+	"fmt"
+	"net/http"
+	"planet-server/diskcache"
+	"planet-server/planet/planettest"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestOverviewRequiresDisk(t *testing.T) {
+	h := newHarness(t)
+	tile := maptile.At(seattle, 8)
+	h.AddFeatures(planettest.NewFeature("scene", tile.Bound(), acquired, "sat1"))
+
+	rec := h.get(tilePath(tile, "date="+date))
+	checkStatus(t, rec, http.StatusBadRequest)
+	if n := h.Requests(planettest.AnyEndpoint); n != 0 {
+		t.Errorf("made %d upstream requests without a disk cache", n)
+	}
+}
+
+func TestOverviewCached(t *testing.T) {
+	h := newHarness(t)
+	disk, err := diskcache.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ts.Disk = disk
+	tile := maptile.At(seattle, 8)
+	h.AddFeatures(planettest.NewFeature("scene", tile.Bound(), acquired, "sat1"))
+
+	checkStatus(t, h.get(tilePath(tile, "date="+date)), http.StatusOK)
+	n := h.Requests(planettest.AnyEndpoint)
+	if n == 0 || n > h.ts.OverviewBudget {
+		t.Errorf("made %d upstream requests, want 1 to %d", n, h.ts.OverviewBudget)
+	}
+	checkStatus(t, h.get(tilePath(tile, "date="+date)), http.StatusOK)
+	if m := h.Requests(planettest.AnyEndpoint); m != n {
+		t.Errorf("repeat request made %d more upstream requests", m-n)
+	}
+}
+
+func TestOverviewBudgetWithoutRetries(t *testing.T) {
+	h := newHarness(t)
+	disk, err := diskcache.New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ts.Disk = disk
+	tile := maptile.At(seattle, 8)
+	for i := 0; i < 20; i++ {
+		h.AddFeatures(planettest.NewFeature(fmt.Sprintf("scene%d", i), tile.Bound(), acquired, "sat1"))
+	}
+	h.Inject(planettest.Fault{Endpoint: planettest.ThumbEndpoint, Status: http.StatusServiceUnavailable})
+
+	checkStatus(t, h.get(tilePath(tile, "date="+date)), http.StatusOK)
+	if n := h.Requests(planettest.AnyEndpoint); n > h.ts.OverviewBudget {
+		t.Errorf("made %d upstream requests, budget is %d", n, h.ts.OverviewBudget)
+	}
+}
@@ -0,0 +1,262 @@
+package tileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"planet-server/planet"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+// tileDiskKey identifies a rendered tile by its coordinates, query and
+// encoding.
+func (s *TileServer) tileDiskKey(t maptile.Tile, scale int, o *output, form url.Values) string {
+	// Encode sorts by key, so equivalent queries share an entry.
+	return fmt.Sprintf("%d/%d/%d@%d %s?%s", t.Z, t.X, t.Y, scale, s.outputKey(o), form.Encode())
+}
+
+// Disk cache entries hold the ETag and content type on their own lines,
+// followed by the encoded tile.
+func (s *TileServer) diskGet(key string) (etag, contentType string, data []byte, ok bool) {
+	b, ok := s.Disk.Get(key)
+	if !ok || len(b) == 0 || b[0] != '"' {
+		return "", "", nil, false
+	}
+	parts := bytes.SplitN(b, []byte{'\n'}, 3)
+	if len(parts) != 3 {
+		return "", "", nil, false
+	}
+	return string(parts[0]), string(parts[1]), parts[2], true
+}
+
+func (s *TileServer) diskPut(key, etag, contentType string, data []byte, ttl time.Duration) {
+	b := make([]byte, 0, len(etag)+len(contentType)+2+len(data))
+	b = append(b, etag...)
+	b = append(b, '\n')
+	b = append(b, contentType...)
+	b = append(b, '\n')
+	b = append(b, data...)
+	if err := s.Disk.Put(key, b, ttl); err != nil {
+		log.Warnf("disk cache put failed: %v", err)
+	}
+}
+
+// tileTTL picks how long a rendered tile stays cached. Imagery for recent
+// dates keeps arriving, while older mosaics and single scenes are stable.
+func tileTTL(form url.Values, now time.Time) time.Duration {
+	if form.Get("id") != "" {
+		return HistoricTileTTL
+	}
+	var newest time.Time
+	if t, err := dateFromRequest(form.Get("date")); err == nil {
+		newest = t.Add(24 * time.Hour)
+	} else if t, err := dateFromRequest(form.Get("end")); err == nil {
+		newest = t.Add(24 * time.Hour)
+	} else if t, err := parseUnix(form.Get("ts")); err == nil {
+		newest = t
+	} else {
+		return RecentTileTTL
+	}
+	switch age := now.Sub(newest); {
+	case age < 2*24*time.Hour:
+		return RecentTileTTL
+	case age < 30*24*time.Hour:
+		return MonthTileTTL
+	default:
+		return HistoricTileTTL
+	}
+}
+
+// tileETag is a strong validator for a tile built from items. The same scenes
+// composited and encoded the same way always produce the same bytes.
+func (s *TileServer) tileETag(tq *tileQuery, o *output, items [][]planet.Item) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d/%d/%d@%d %s %s", tq.Tile.Z, tq.Tile.X, tq.Tile.Y, tq.Scale, tq.Mode, s.outputKey(o))
+	for _, sub := range items {
+		fmt.Fprint(h, " |")
+		for _, item := range sub {
+			fmt.Fprintf(h, " %s/%s", item.Type, item.ID)
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatch reports whether an If-None-Match header matches etag.
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTile sends an encoded tile, or 304 if the client already has it.
+func writeTile(w http.ResponseWriter, r *http.Request, etag, contentType string, ttl time.Duration, data []byte) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(data); err != nil {
+		// These errors are expected when clients abort requests.
+		log.Debugf("tile write failed: %v", err)
+	}
+}
+
+// writeError reports a failed tile, as an error tile with status 200 unless
+// real status codes are enabled.
+func (s *TileServer) writeError(w http.ResponseWriter, err error, status int) {
+	if !errors.Is(err, ErrZoom) {
+		log.Errorf("serve tile error: %v", err)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if !s.ErrorStatus {
+		status = http.StatusOK
+	} else {
+		planet.SetRetryAfter(w, err)
+	}
+	if s.ErrorStatus && !s.ErrorBody {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, toErrorTile(err)); err != nil {
+		log.Errorf("png encode failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (s *TileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ttl := tileTTL(r.Form, time.Now())
+
+	o, err := parseOutput(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == ErrWebPUnsupported {
+			status = http.StatusNotAcceptable
+		}
+		s.writeError(w, err, status)
+		return
+	}
+	if o.Format == "" {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	tile, err := tileFromRequest(r)
+	if err == nil && tile.Z < MinZ && ttl > MonthTileTTL {
+		// Overviews improve as more of their children are cached.
+		ttl = MonthTileTTL
+	}
+
+	var key string
+	if s.Disk != nil && err == nil {
+		scale := 1
+		if mux.Vars(r)["scale"] == "@2x" {
+			scale = 2
+		}
+		key = s.tileDiskKey(tile, scale, o, r.Form)
+		if etag, contentType, data, ok := s.diskGet(key); ok {
+			writeTile(w, r, etag, contentType, ttl, data)
+			return
+		}
+	}
+
+	tq, err := s.parseTile(r)
+	if err != nil {
+		s.writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if tq.Overview {
+		s.serveOverview(w, r, tq, o, key, ttl)
+		return
+	}
+	items, err := s.getItems(r.Context(), tq)
+	if err != nil {
+		s.writeError(w, err, planet.StatusCode(err))
+		return
+	}
+
+	// The scene set is known before any imagery is fetched, so a client that
+	// has the tile already is answered without downloading it.
+	etag := s.tileETag(tq, o, items)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		writeTile(w, r, etag, "", ttl, nil)
+		return
+	}
+
+	img, failed, err := s.renderTile(r.Context(), tq, items)
+	if err != nil {
+		s.writeError(w, err, planet.StatusCode(err))
+		return
+	}
+
+	data, contentType, err := s.encode(o, img)
+	if err != nil {
+		log.Errorf("tile encode failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(failed) > 0 {
+		// Degraded tiles lack some scenes, so they are neither cached nor
+		// given the ETag of the complete tile.
+		ids := make([]string, len(failed))
+		for i, item := range failed {
+			ids[i] = item.ID
+		}
+		w.Header().Set(DegradedHeader, strings.Join(ids, ","))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+		return
+	}
+
+	if key != "" {
+		s.diskPut(key, etag, contentType, data, ttl)
+	}
+	writeTile(w, r, etag, contentType, ttl, data)
+}
+
+// serveOverview renders an overview tile. Its content depends on what was
+// cached at the time, so the ETag is derived from the encoded bytes.
+func (s *TileServer) serveOverview(w http.ResponseWriter, r *http.Request, tq *tileQuery, o *output, key string, ttl time.Duration) {
+	img, err := s.renderOverview(r.Context(), tq, o, r.Form)
+	if err != nil {
+		s.writeError(w, err, planet.StatusCode(err))
+		return
+	}
+	data, contentType, err := s.encode(o, img)
+	if err != nil {
+		log.Errorf("tile encode failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if key != "" {
+		s.diskPut(key, etag, contentType, data, ttl)
+	}
+	writeTile(w, r, etag, contentType, ttl, data)
+}
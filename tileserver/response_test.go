@@ -0,0 +1,132 @@
+package tileserver_test
+
+import (
+	"fmt"
+	"net/http"
+	"planet-server/planet"
+	"planet-server/planet/planettest"
+	"planet-server/tileserver"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// noSceneCache makes every tile render fetch its scenes upstream.
+func noSceneCache(o *planet.Options) {
+	o.SceneCacheSize = -1
+}
+
+func TestNotModified(t *testing.T) {
+	h := newHarness(t, noSceneCache)
+	tile := maptile.At(seattle, 12)
+	h.AddFeatures(planettest.NewFeature("scene", tile.Bound().Pad(0.1), acquired, "sat1"))
+	path := tilePath(tile, "date="+date)
+
+	rec := h.get(path)
+	checkStatus(t, rec, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("no ETag")
+	}
+	fetches := h.Requests(planettest.TileEndpoint)
+
+	rec = h.get(path, "If-None-Match", etag)
+	checkStatus(t, rec, http.StatusNotModified)
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 with a %d byte body", rec.Body.Len())
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %s, want %s", got, etag)
+	}
+	if n := h.Requests(planettest.TileEndpoint); n != fetches {
+		t.Errorf("304 fetched %d upstream tiles", n-fetches)
+	}
+
+	// A stale validator gets the tile again.
+	rec = h.get(path, "If-None-Match", `"stale"`)
+	checkStatus(t, rec, http.StatusOK)
+	if n := h.Requests(planettest.TileEndpoint); n != fetches+1 {
+		t.Errorf("fetched %d upstream tiles for a stale validator, want 1", n-fetches)
+	}
+}
+
+func TestETagVariesWithQuery(t *testing.T) {
+	h := newHarness(t)
+	tile := maptile.At(seattle, 12)
+	// Each covers the tile, and the sort order decides which is shown.
+	newer := planettest.NewFeature("newer", tile.Bound().Pad(0.1), acquired, "sat1")
+	newer.Properties.ClearPercent = 50
+	clearer := planettest.NewFeature("clearer", tile.Bound().Pad(0.1), acquired.Add(-time.Hour), "sat2")
+	h.AddFeatures(newer, clearer)
+
+	etag := func(path string) string {
+		t.Helper()
+		rec := h.get(path)
+		checkStatus(t, rec, http.StatusOK)
+		return rec.Header().Get("ETag")
+	}
+	jpg := func(query string) string {
+		return etag(fmt.Sprintf("/api/tile/%d/%d/%d.jpg?%s", tile.Z, tile.X, tile.Y, query))
+	}
+
+	base := jpg("date=" + date)
+	if same := jpg("sort=newest&date=" + date); same != base {
+		t.Errorf("equivalent query changed the ETag: %s, %s", base, same)
+	}
+	for _, query := range []string{
+		"date=" + date + "&sort=clear",
+		"date=" + date + "&composite=best",
+		"date=" + date + "&quality=50",
+	} {
+		if got := jpg(query); got == base {
+			t.Errorf("%s has the same ETag as the base tile", query)
+		}
+	}
+	if got := etag(tilePath(tile, "date="+date)); got == base {
+		t.Errorf("PNG has the same ETag as JPEG")
+	}
+
+	// The server default quality is part of the ETag too.
+	h.ts.JPEGQuality = 50
+	if got := jpg("date=" + date); got == base {
+		t.Errorf("changing the default quality kept the ETag")
+	}
+	if got, want := jpg("date="+date), jpg("date="+date+"&quality=50"); got != want {
+		t.Errorf("default and explicit quality 50 differ: %s, %s", got, want)
+	}
+}
+
+func TestDegradedNotCached(t *testing.T) {
+	h := newHarness(t, noSceneCache)
+	tile := maptile.At(seattle, 12)
+	b := tile.Bound()
+	c := b.Center()
+	// Each scene covers half the tile, so both are needed.
+	h.AddFeatures(
+		planettest.NewFeature("west", orb.Bound{Min: b.Min, Max: orb.Point{c.X(), b.Max.Y()}}.Pad(0.001), acquired, "sat1"),
+		planettest.NewFeature("east", orb.Bound{Min: orb.Point{c.X(), b.Min.Y()}, Max: b.Max}.Pad(0.001), acquired, "sat2"),
+	)
+	// Not found is not retried, so one of the scenes fails.
+	h.Inject(planettest.Fault{Endpoint: planettest.TileEndpoint, Status: http.StatusNotFound, Count: 1})
+
+	rec := h.get(tilePath(tile, "date="+date))
+	checkStatus(t, rec, http.StatusOK)
+	if rec.Header().Get(tileserver.DegradedHeader) == "" {
+		t.Fatalf("tile with a failed scene not marked degraded")
+	}
+	if got := rec.Header().Get("ETag"); got != "" {
+		t.Errorf("degraded tile has ETag %s", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("degraded tile Cache-Control = %q, want no-store", got)
+	}
+
+	// Once upstream recovers the complete tile is cacheable.
+	rec = h.get(tilePath(tile, "date="+date))
+	checkStatus(t, rec, http.StatusOK)
+	if rec.Header().Get(tileserver.DegradedHeader) != "" || rec.Header().Get("ETag") == "" {
+		t.Errorf("complete tile: degraded %q, ETag %q", rec.Header().Get(tileserver.DegradedHeader), rec.Header().Get("ETag"))
+	}
+}
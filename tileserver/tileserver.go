@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
+	"image/draw"
 	"net/http"
+	"net/url"
+	"planet-server/diskcache"
 	"planet-server/planet"
 	"planet-server/tilecache"
 	"planet-server/util"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eidolon/wordwrap"
@@ -36,6 +39,21 @@ const (
 	TileSize = 256
 
 	MinZ = 11
+
+	// Maximum number of scenes stacked for per-pixel compositing.
+	MaxCompositeScenes = 6
+
+	// Maximum span of a date range mosaic.
+	MaxRangeDays = 31
+
+	// Lifetimes of rendered tiles in the disk cache, by the age of the
+	// newest imagery they may include. Recent dates still receive new scenes.
+	RecentTileTTL   = 15 * time.Minute
+	MonthTileTTL    = 6 * time.Hour
+	HistoricTileTTL = 30 * 24 * time.Hour
+
+	// Response header listing the IDs of scenes missing from a degraded tile.
+	DegradedHeader = "X-Tile-Degraded"
 )
 
 var (
@@ -45,12 +63,34 @@ var (
 type TileServer struct {
 	Cache  *tilecache.MultiCache
 	Client *planet.Client
+
+	// Cache of rendered tiles; nil disables it.
+	Disk *diskcache.DiskCache
+
+	// Return real 4xx/5xx status codes for failed tiles instead of 200, and
+	// whether those responses still carry an error tile.
+	ErrorStatus bool
+	ErrorBody   bool
+
+	// Default encoder quality for lossy formats, from 1 to 100.
+	JPEGQuality int
+	WebPQuality int
+
+	// Upstream calls allowed per overview tile below MinZ; 0 disables
+	// overviews. Overviews also require Disk, as they are too costly to
+	// render on every request.
+	OverviewBudget int
 }
 
 func New(p *planet.Client) *TileServer {
 	return &TileServer{
-		Cache:  tilecache.NewMulti(),
-		Client: p,
+		Cache:       tilecache.NewMulti(),
+		Client:      p,
+		ErrorBody:   true,
+		JPEGQuality: DefaultJPEGQuality,
+		WebPQuality: DefaultWebPQuality,
+
+		OverviewBudget: DefaultOverviewBudget,
 	}
 }
 
@@ -71,11 +111,28 @@ func tileFromRequest(r *http.Request) (maptile.Tile, error) {
 }
 
 func dateFromRequest(v string) (time.Time, error) {
-	if v == "" {
-		return time.Time{}, fmt.Errorf("missing date")
+	return util.ParseDate(v)
+}
+
+// dateRangeFromRequest parses the inclusive start and end dates of a date
+// range mosaic, returning the searched window.
+func dateRangeFromRequest(r *http.Request) (time.Time, time.Time, error) {
+	start, err := dateFromRequest(r.Form.Get("start"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start %q: %v", r.Form.Get("start"), err)
 	}
-	// TODO request from frontend can include TZ
-	return time.ParseInLocation("2006-01-02", v, util.LocationOrDie())
+	end, err := dateFromRequest(r.Form.Get("end"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end %q: %v", r.Form.Get("end"), err)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end %q before start %q", r.Form.Get("end"), r.Form.Get("start"))
+	}
+	end = end.AddDate(0, 0, 1)
+	if end.Sub(start) > MaxRangeDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("date range exceeds %d days", MaxRangeDays)
+	}
+	return start, end, nil
 }
 
 func blankImage() *image.RGBA {
@@ -85,13 +142,29 @@ func blankImage() *image.RGBA {
 	})
 }
 
+// errorColors picks the border and text colors of an error tile, so that
+// different failures can be told apart on the map at a glance.
+func errorColors(err error) (border, text color.RGBA) {
+	switch {
+	case errors.Is(err, planet.ErrRateLimited), errors.Is(err, planet.ErrBudgetExhausted):
+		return color.RGBA{255, 140, 0, 255}, color.RGBA{255, 140, 0, 255}
+	case errors.Is(err, planet.ErrUnauthorized):
+		return color.RGBA{255, 0, 255, 255}, color.RGBA{255, 0, 255, 255}
+	case errors.Is(err, planet.ErrNotFound):
+		return color.RGBA{128, 128, 128, 255}, color.RGBA{128, 128, 128, 255}
+	default:
+		return color.RGBA{255, 255, 0, 255}, color.RGBA{255, 0, 0, 255}
+	}
+}
+
 func toErrorTile(err error) image.Image {
 	img := blankImage()
+	border, col := errorColors(err)
 
 	gc := draw2dimg.NewGraphicContext(img)
 
 	gc.Save()
-	gc.SetStrokeColor(color.RGBA{255, 255, 0, 255})
+	gc.SetStrokeColor(border)
 	gc.SetFillColor(color.RGBA{0, 0, 0, 0})
 	gc.SetLineWidth(1)
 
@@ -107,13 +180,12 @@ func toErrorTile(err error) image.Image {
 
 	padding := 5
 
-	col := color.RGBA{255, 0, 0, 255}
 	wrapper := wordwrap.Wrapper((256-(2*padding))/7, false)
 	lines := strings.Split(wrapper(err.Error()), "\n")
 
 	p := 7 + padding
 	for _, line := range lines {
-		point := fixed.Point26_6{fixed.Int26_6(padding * 64), fixed.Int26_6(p * 64)}
+		point := fixed.Point26_6{X: fixed.Int26_6(padding * 64), Y: fixed.Int26_6(p * 64)}
 		p += 14
 		d := &font.Drawer{
 			Dst:  img,
@@ -126,93 +198,112 @@ func toErrorTile(err error) image.Image {
 	return img
 }
 
-func (s *TileServer) getFeatures(pctx context.Context, tile maptile.Tile, ts time.Time, satellite string) ([]*planet.Feature, error) {
-	ctx, cancel := context.WithCancel(pctx)
-	defer cancel()
+// mosaicQuery describes the scenes searched for a mosaic tile. It doubles as
+// the key for the search result cache.
+type mosaicQuery struct {
+	// Acquisition window for date and date range mosaics. Satellite mosaics
+	// search around Start and leave End unset.
+	Start     time.Time
+	End       time.Time
+	Satellite string `json:",omitempty"`
+	ItemTypes []string
+	Quality   planet.Quality
+}
 
-	var cache *tilecache.TileCache
-	if satellite == "" {
-		cache = s.Cache.For(ts)
+func (q *mosaicQuery) request(region orb.Bound) *planet.Request {
+	var req *planet.Request
+	if q.Satellite == "" {
+		req = planet.RequestRegion(region, q.Start, q.End, q.ItemTypes)
 	} else {
-		key := struct {
-			Ts        time.Time
-			Satellite string
-		}{ts, satellite}
-		cache = s.Cache.For(key)
+		req = planet.RequestRegionForSatellite(region, q.Start, q.Satellite, q.ItemTypes)
 	}
+	q.Quality.Apply(req)
+	return req
+}
 
-	// Try the cache directly first.
-	features, ok := cache.Get(tile.Bound())
-	if ok {
-		return features, nil
+// ranking reads the optional sort and target parameters. The target time for
+// sort=time defaults to the middle of the searched window.
+func (q *mosaicQuery) ranking(form url.Values) (planet.Ranking, error) {
+	var rank planet.Ranking
+	var err error
+	rank.Order, err = planet.ParseSortOrder(form.Get("sort"))
+	if err != nil {
+		return rank, err
 	}
-
-	apic := make(chan []*planet.Feature, 1)
-	errc := make(chan error, 1)
-	go func() {
-		// Request a padded region to reduce the number of API requests.
-		region := tile.Bound(BoundExpand)
-
-		var req *planet.Request
-		if satellite == "" {
-			req = planet.RequestRegionOnDate(region, ts)
-		} else {
-			req = planet.RequestRegionForSatellite(region, ts, satellite)
+	if form.Get("target") != "" {
+		rank.Target, err = parseUnix(form.Get("target"))
+		if err != nil {
+			return rank, fmt.Errorf("bad target: %v", err)
 		}
+	} else if q.Satellite == "" {
+		rank.Target = q.Start.Add(q.End.Sub(q.Start) / 2)
+	} else {
+		rank.Target = q.Start
+	}
+	return rank, nil
+}
 
-		resp, err := s.Client.QuickSearch(ctx, req)
+func (s *TileServer) getFeatures(ctx context.Context, tile maptile.Tile, q *mosaicQuery) ([]*planet.Feature, error) {
+	// Search a padded region to reduce the number of API requests; nearby
+	// tiles are then served from the cache or share the search in flight.
+	return s.Cache.For(q).Do(ctx, tile.Bound(), tile.Bound(BoundExpand), func(ctx context.Context, region orb.Bound) ([]*planet.Feature, error) {
+		resp, err := s.Client.QuickSearchAll(ctx, q.request(region))
 		if err != nil {
-			errc <- err
-			return
+			return nil, err
 		}
-		cache.Put(region, resp.Features)
-		apic <- resp.Features
-	}()
-
-	watcher := cache.Watch(tile.Bound())
-	defer watcher.Close()
-
-	// Wait for either the API to return a result, or we get an equivalent result
-	// from the cache.
-	select {
-	case features := <-watcher.C:
-		log.Debugf("Resolved request from watcher")
-		return features, nil
-	case features := <-apic:
-		return features, nil
-	case err := <-errc:
-		return nil, err
-	}
+		return resp.Features, nil
+	})
 }
 
-func getTileIDs(tile maptile.Tile, features []*planet.Feature) []string {
-	var IDs []string
-	var union orb.Polygon
-	for _, f := range features {
+// getTileItems picks the features covering a tile in ranked order. For plain
+// overlays it stops once the tile is fully covered; per-pixel compositing
+// keeps collecting fallback scenes up to MaxCompositeScenes.
+func getTileItems(tile maptile.Tile, features []*planet.Feature, rank planet.Ranking, mode planet.Composite) []planet.Item {
+	var items []planet.Item
+	var union orb.MultiPolygon
+	for _, f := range rank.Sort(features) {
+		if f.Geometry == nil {
+			log.Warnf("Tile %q: missing footprint", f.ID)
+			continue
+		}
 		g := f.Geometry.Geometry()
-		p, ok := g.(orb.Polygon)
-		if !ok {
-			log.Fatal("not polygon")
+		switch g.(type) {
+		case orb.Polygon, orb.MultiPolygon:
+		default:
+			log.Warnf("Tile %q: unsupported footprint type %s", f.ID, g.GeoJSONType())
+			continue
 		}
 
-		intersect := clip.Polygon(tile.Bound(), p.Clone())
+		intersect := clip.Geometry(tile.Bound(), orb.Clone(g))
+		if intersect == nil {
+			continue // Not a matching tile
+		}
 
 		overlap := planar.Area(intersect) / planar.Area(tile.Bound())
 		if overlap == 0 {
 			continue // Not a matching tile
 		}
 
-		union = util.PolyUnion(union, intersect)
+		u, err := util.PolyUnion(union, intersect)
+		if err != nil {
+			log.Warnf("Tile %q: union failed: %v", f.ID, err)
+		} else {
+			union = u
+		}
 		coverage := planar.Area(union) / planar.Area(tile.Bound())
-		IDs = append(IDs, f.ID)
+		items = append(items, f.Item())
 
 		log.Debugf("Tile %q: overlap %.2f, coverage %.2f", f.ID, overlap, coverage)
 
-		if coverage >= 1 {
+		if mode == planet.CompositeBest {
+			if len(items) >= MaxCompositeScenes {
+				break
+			}
+		} else if coverage >= 1 {
 			break
 		}
 	}
-	return IDs
+	return items
 }
 
 func parseUnix(s string) (time.Time, error) {
@@ -226,78 +317,199 @@ func parseUnix(s string) (time.Time, error) {
 	return time.Unix(i, 0), nil
 }
 
-func (s *TileServer) getTile(r *http.Request) (image.Image, error) {
+// tileQuery is a parsed tile request.
+type tileQuery struct {
+	Tile maptile.Tile
+	Mode planet.Composite
+	// 2 for high-DPI tiles, which are stitched from the four children of Tile.
+	Scale int
+	// Set for mosaics below MinZ, which are rendered as overviews.
+	Overview bool
+
+	// Set when a single scene is requested by ID.
+	Item *planet.Item
+
+	// Otherwise the mosaic to render and how its scenes are ranked.
+	Mosaic *mosaicQuery
+	Rank   planet.Ranking
+}
+
+// overviewAllowed reports whether a mosaic tile below MinZ may be served as an
+// overview. Only the disk cache keeps what an overview fetched, so without it
+// they are refused like any other low zoom tile.
+func (s *TileServer) overviewAllowed(tile maptile.Tile) bool {
+	return s.OverviewBudget > 0 && s.Disk != nil && tile.Z >= OverviewMinZ
+}
+
+// parseTile reads a tile request. Any error is the client's fault.
+func (s *TileServer) parseTile(r *http.Request) (*tileQuery, error) {
 	tile, err := tileFromRequest(r)
 	if err != nil {
 		return nil, err
 	}
+	tq := &tileQuery{Tile: tile, Scale: 1}
+	if mux.Vars(r)["scale"] == "@2x" {
+		tq.Scale = 2
+	}
 
 	ID := r.Form.Get("id")
 	date := r.Form.Get("date")
 
-	var IDs []string
+	tq.Mode, err = planet.ParseComposite(r.Form.Get("composite"))
+	if err != nil {
+		return nil, err
+	}
+
 	if ID != "" {
 		// Search by ID
-		IDs = []string{ID}
-	} else {
-		// Search by date or satellite (mosaic)
-		var sat string
-		var ts time.Time
-
-		if date != "" {
-			// Search by date
-			var err error
-			ts, err = dateFromRequest(r.Form.Get("date"))
-			if err != nil {
-				return nil, fmt.Errorf("invalid date %q: %v", r.Form["date"], err)
-			}
-			if tile.Z < MinZ {
-				// Zoom is bounded for date mosaic to prevent insane tile server load
+		item := planet.Item{Type: r.Form.Get("item_type"), ID: ID}
+		if item.Type == "" {
+			item.Type = s.Client.ItemTypes()[0]
+		}
+		if err := s.Client.CheckItemType(item.Type); err != nil {
+			return nil, err
+		}
+		tq.Item = &item
+		return tq, nil
+	}
+
+	// Search by date, date range or satellite (mosaic)
+	q := &mosaicQuery{}
+
+	if date != "" {
+		// Search by date
+		q.Start, err = dateFromRequest(r.Form.Get("date"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q: %v", r.Form["date"], err)
+		}
+		q.End = q.Start.Add(24 * time.Hour)
+		if tile.Z < MinZ {
+			// Zoom is bounded for date mosaic to prevent insane tile server load
+			if !s.overviewAllowed(tile) {
 				return nil, ErrZoom
 			}
-		} else {
-			// Search by satellite
-			sat = r.Form.Get("satellite_id")
-			if sat == "" {
-				return nil, fmt.Errorf("missing satellite_id")
-			}
-			var err error
-			ts, err = parseUnix(r.Form.Get("ts"))
-			if err != nil {
-				return nil, err
+			tq.Overview = true
+		}
+	} else if r.Form.Get("start") != "" || r.Form.Get("end") != "" {
+		// Search by date range
+		q.Start, q.End, err = dateRangeFromRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		if tile.Z < MinZ {
+			if !s.overviewAllowed(tile) {
+				return nil, ErrZoom
 			}
+			tq.Overview = true
 		}
-
-		features, err := s.getFeatures(r.Context(), tile, ts, sat)
+	} else {
+		// Search by satellite
+		q.Satellite = r.Form.Get("satellite_id")
+		if q.Satellite == "" {
+			return nil, fmt.Errorf("missing satellite_id")
+		}
+		q.Start, err = parseUnix(r.Form.Get("ts"))
 		if err != nil {
 			return nil, err
 		}
-
-		IDs = getTileIDs(tile, features)
 	}
 
-	img, err := s.Client.FetchTiles(r.Context(), IDs, tile)
+	q.ItemTypes, err = s.Client.ParseItemTypes(r.Form.Get("item_types"))
+	if err != nil {
+		return nil, err
+	}
+	q.Quality, err = planet.ParseQuality(r.Form)
+	if err != nil {
+		return nil, err
+	}
+	tq.Rank, err = q.ranking(r.Form)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch tiles: %v", err)
+		return nil, err
 	}
+	tq.Mosaic = q
+	return tq, nil
+}
 
-	return img, nil
+// subTiles returns the upstream tiles composited into the response, in the
+// order of their items.
+func (tq *tileQuery) subTiles() maptile.Tiles {
+	if tq.Scale == 2 {
+		return tq.Tile.Children()
+	}
+	return maptile.Tiles{tq.Tile}
 }
 
-func (s *TileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	w.Header().Set("Content-Type", "image/png")
-	var img image.Image
-	img, err := s.getTile(r)
+// getItems returns the scenes that make up each sub-tile, in priority order.
+// Sub-tiles of a high-DPI tile share a single feature lookup, so they are
+// ranked consistently.
+func (s *TileServer) getItems(ctx context.Context, tq *tileQuery) ([][]planet.Item, error) {
+	subs := tq.subTiles()
+	items := make([][]planet.Item, len(subs))
+	if tq.Item != nil {
+		for i := range subs {
+			items[i] = []planet.Item{*tq.Item}
+		}
+		return items, nil
+	}
+	features, err := s.getFeatures(ctx, tq.Tile, tq.Mosaic)
 	if err != nil {
-		if err != ErrZoom {
-			log.Errorf("serve tile error: %v", err)
+		return nil, err
+	}
+	for i, sub := range subs {
+		items[i] = getTileItems(sub, features, tq.Rank, tq.Mode)
+	}
+	return items, nil
+}
+
+// renderTile composites the scenes of each sub-tile and stitches them
+// together. Scenes that failed to download are returned alongside the image.
+func (s *TileServer) renderTile(ctx context.Context, tq *tileQuery, items [][]planet.Item) (image.Image, []planet.Item, error) {
+	subs := tq.subTiles()
+	imgs := make([]image.Image, len(subs))
+	failed := make([][]planet.Item, len(subs))
+	errs := make([]error, len(subs))
+	wg := &sync.WaitGroup{}
+	for i, sub := range subs {
+		wg.Add(1)
+		go func(i int, sub maptile.Tile) {
+			defer wg.Done()
+			imgs[i], failed[i], errs[i] = s.Client.FetchTiles(ctx, items[i], sub, tq.Mode)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	// A sub-tile that failed entirely is left blank, unless all of them did.
+	var allFailed []planet.Item
+	var ferr error
+	n := 0
+	for i := range subs {
+		if errs[i] != nil {
+			allFailed = append(allFailed, items[i]...)
+			if ferr == nil {
+				ferr = errs[i]
+			}
+			continue
 		}
-		img = toErrorTile(err)
+		allFailed = append(allFailed, failed[i]...)
+		n++
+	}
+	if n == 0 {
+		return nil, nil, fmt.Errorf("failed to fetch tiles: %w", ferr)
+	}
+	if len(allFailed) > 0 {
+		log.Warnf("Tile %v degraded, %d scenes failed", tq.Tile, len(allFailed))
 	}
 
-	if err := png.Encode(w, img); err != nil {
-		// These errors are expected when clients abort requests.
-		log.Debugf("png encode failed: %v", err)
+	if tq.Scale == 1 {
+		return imgs[0], allFailed, nil
+	}
+	out := image.NewRGBA(image.Rect(0, 0, 2*TileSize, 2*TileSize))
+	for i, sub := range subs {
+		if imgs[i] == nil {
+			continue
+		}
+		at := image.Pt(int(sub.X-2*tq.Tile.X)*TileSize, int(sub.Y-2*tq.Tile.Y)*TileSize)
+		draw.Draw(out, imgs[i].Bounds().Sub(imgs[i].Bounds().Min).Add(at), imgs[i], imgs[i].Bounds().Min, draw.Src)
 	}
+	return out, allFailed, nil
 }
@@ -0,0 +1,133 @@
+package tileserver_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"planet-server/planet"
+	"planet-server/planet/planettest"
+	"planet-server/tileserver"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+var (
+	seattle  = orb.Point{-122.33, 47.61}
+	acquired = time.Date(2022, 6, 1, 18, 0, 0, 0, time.UTC)
+)
+
+const date = "2022-06-01"
+
+// harness serves tiles from a TileServer backed by a fake Planet API.
+type harness struct {
+	*planettest.Server
+	ts     *tileserver.TileServer
+	router *mux.Router
+}
+
+func newHarness(t *testing.T, opts ...func(*planet.Options)) *harness {
+	t.Helper()
+	// A key in the environment keeps the client away from datastore.
+	t.Setenv("PLANET_API_KEY", "test")
+	t.Setenv("TZ", "UTC")
+
+	s := planettest.NewServer()
+	t.Cleanup(s.Close)
+	o := s.Options()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	h := &harness{
+		Server: s,
+		ts:     tileserver.New(planet.New(context.Background(), o)),
+		router: mux.NewRouter(),
+	}
+	h.ts.ErrorStatus = true
+	h.router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}", h.ts)
+	h.router.Handle("/api/tile/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}{scale:(?:@2x)?}.{ext:png|jpg|jpeg|webp}", h.ts)
+	return h
+}
+
+// get requests a tile with extra headers given as name, value pairs.
+func (h *harness) get(path string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, r)
+	return rec
+}
+
+func tilePath(t maptile.Tile, query string) string {
+	return fmt.Sprintf("/api/tile/%d/%d/%d.png?%s", t.Z, t.X, t.Y, query)
+}
+
+func checkStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body.String())
+	}
+}
+
+func TestMultiPolygonScene(t *testing.T) {
+	// The easternmost tile at z12, next to the antimeridian.
+	tile := maptile.At(orb.Point{179.95, 65}, 12)
+	b := tile.Bound()
+	west := orb.Bound{Min: orb.Point{-180, b.Min.Y() - 0.1}, Max: orb.Point{-179.8, b.Max.Y() + 0.1}}
+	east := orb.Bound{Min: orb.Point{179.8, b.Min.Y() - 0.1}, Max: orb.Point{180, b.Max.Y() + 0.1}}
+	// Covers only the northern half of the tile.
+	north := orb.Bound{Min: orb.Point{179.8, b.Center().Y()}, Max: orb.Point{180, b.Max.Y() + 0.1}}
+
+	tests := []struct {
+		name  string
+		split orb.MultiPolygon
+		// Upstream tiles fetched; the fallback is needed only when the split
+		// scene leaves part of the tile uncovered.
+		fetches int
+	}{
+		{"covering", orb.MultiPolygon{west.ToPolygon(), east.ToPolygon()}, 1},
+		{"partial", orb.MultiPolygon{west.ToPolygon(), north.ToPolygon()}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			// The split scene is newer, so ranks first.
+			h.AddFeatures(
+				planettest.NewFeatureWithGeometry("split", tt.split, time.Date(2022, 6, 1, 20, 0, 0, 0, time.UTC), "sat1"),
+				planettest.NewFeature("fallback", b.Pad(0.1), time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC), "sat2"),
+			)
+
+			rec := h.get(tilePath(tile, "date="+date))
+			checkStatus(t, rec, http.StatusOK)
+			img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("decode tile: %v", err)
+			}
+			// Fake upstream tiles are opaque, so the top ranked scene fills
+			// the tile.
+			checkColor(t, img.At(128, 128), "split")
+			if n := h.Requests(planettest.TileEndpoint); n != tt.fetches {
+				t.Errorf("fetched %d upstream tiles, want %d", n, tt.fetches)
+			}
+		})
+	}
+}
+
+// checkColor checks that a pixel came from the scene with the given ID.
+func checkColor(t *testing.T, c color.Color, ID string) {
+	t.Helper()
+	want := planettest.ColorFor(ID)
+	r, g, b, a := c.RGBA()
+	if uint8(r>>8) != want.R || uint8(g>>8) != want.G || uint8(b>>8) != want.B || a>>8 != 255 {
+		t.Errorf("pixel = %d, %d, %d, %d; want %v from %s", r>>8, g>>8, b>>8, a>>8, want, ID)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build cgo
+
+package tileserver
+
+import (
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+// WebP encoding uses libwebp and is only available in cgo builds.
+const webpSupported = true
+
+func encodeWebP(img image.Image, quality int) ([]byte, error) {
+	if isOpaque(img) {
+		return webp.EncodeRGB(img, float32(quality))
+	}
+	return webp.EncodeRGBA(img, float32(quality))
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package tileserver
+
+import (
+	"errors"
+	"image"
+)
+
+const webpSupported = false
+
+func encodeWebP(img image.Image, quality int) ([]byte, error) {
+	return nil, errors.New("webp requires a cgo build")
+}
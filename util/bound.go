@@ -0,0 +1,10 @@
+package util
+
+import "github.com/paulmach/orb"
+
+// Overlaps reports whether two bounds share a region of positive area,
+// unlike Bound.Intersects which also accepts touching edges.
+func Overlaps(a, b orb.Bound) bool {
+	return a.Min.X() < b.Max.X() && b.Min.X() < a.Max.X() &&
+		a.Min.Y() < b.Max.Y() && b.Min.Y() < a.Max.Y()
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+)
+
+const (
+	// Number of sample points along each axis used by Coverage.
+	coverageSamples = 64
+)
+
+func contains(g orb.Geometry, p orb.Point) bool {
+	switch g := g.(type) {
+	case orb.Polygon:
+		return planar.PolygonContains(g, p)
+	case orb.MultiPolygon:
+		return planar.MultiPolygonContains(g, p)
+	case orb.Bound:
+		return g.Contains(p)
+	}
+	return false
+}
+
+// Coverage estimates the fraction of the area of region covered by the union
+// of the footprints, by sampling a grid over the region's bound.
+func Coverage(region orb.Geometry, footprints ...orb.Geometry) float64 {
+	b := region.Bound()
+	dx := (b.Max.X() - b.Min.X()) / coverageSamples
+	dy := (b.Max.Y() - b.Min.Y()) / coverageSamples
+
+	inside, covered := 0, 0
+	for i := 0; i < coverageSamples; i++ {
+		for j := 0; j < coverageSamples; j++ {
+			p := orb.Point{b.Min.X() + (float64(i)+0.5)*dx, b.Min.Y() + (float64(j)+0.5)*dy}
+			if !contains(region, p) {
+				continue
+			}
+			inside++
+			for _, f := range footprints {
+				if f != nil && f.Bound().Contains(p) && contains(f, p) {
+					covered++
+					break
+				}
+			}
+		}
+	}
+	if inside == 0 {
+		return 0
+	}
+	return float64(covered) / float64(inside)
+}
@@ -0,0 +1,15 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// ParseDate parses a YYYY-MM-DD date as midnight in the configured location.
+func ParseDate(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, fmt.Errorf("missing date")
+	}
+	// TODO request from frontend can include TZ
+	return time.ParseInLocation("2006-01-02", v, LocationOrDie())
+}
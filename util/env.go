@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -27,6 +28,30 @@ func EnvOrDefaultInt(key string, fallback int) int {
 	return i
 }
 
+func EnvOrDefaultFloat(key string, fallback float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func EnvOrDefaultBool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
 func LocationOrDie() *time.Location {
 	loc, err := time.LoadLocation(EnvOrDefault("TZ", "America/Los_Angeles"))
 	if err != nil {
@@ -34,3 +59,15 @@ func LocationOrDie() *time.Location {
 	}
 	return loc
 }
+
+// SplitList splits a comma separated list, trimming entries and dropping
+// blank ones.
+func SplitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
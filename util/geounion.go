@@ -6,16 +6,16 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// GeoUnion unions two footprints, returning a Polygon when the result is a
+// single part and a MultiPolygon otherwise.
 func GeoUnion(g1, g2 orb.Geometry) orb.Geometry {
-	p1, ok := g1.(orb.Polygon)
-	if !ok {
-		log.Errorf("p1 not a polygon")
-		return g2
-	}
-	p2, ok := g2.(orb.Polygon)
-	if !ok {
-		log.Errorf("p1 not a polygon")
+	mp, err := PolyUnion(g1, g2)
+	if err != nil {
+		log.Errorf("union failed: %v", err)
 		return g1
 	}
-	return PolyUnion(p1, p2)
+	if len(mp) == 1 {
+		return mp[0]
+	}
+	return mp
 }
@@ -1,50 +1,85 @@
 package util
 
 import (
-	"github.com/paulmach/orb"
+	"fmt"
 
-	hull "github.com/furstenheim/go-convex-hull-2d"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/peterstace/simplefeatures/geom"
 )
 
-type coordinates []orb.Point
-
-func (c coordinates) Take(i int) (x, y float64) {
-	return c[i][0], c[i][1]
-}
-
-func (c coordinates) Len() int {
-	return len(c)
-}
-
-func (c coordinates) Swap(i, j int) {
-	c[i], c[j] = c[j], c[i]
+// toGeom converts an orb geometry to a simplefeatures geometry. Geometries
+// are not validated; Planet footprints are occasionally slightly invalid and
+// the overlay algorithms cope with that better than a hard failure.
+func toGeom(g orb.Geometry) (geom.Geometry, error) {
+	if g == nil {
+		return geom.Geometry{}, nil
+	}
+	b, err := wkb.Marshal(g)
+	if err != nil {
+		return geom.Geometry{}, err
+	}
+	return geom.UnmarshalWKB(b, geom.NoValidate{})
 }
 
-func (c coordinates) Slice(i, j int) hull.Interface {
-	return c[i:j]
+// polygons collects the polygonal parts of a geometry, dropping any lower
+// dimensional parts produced by the overlay (e.g. shared edges).
+func polygons(g orb.Geometry) orb.MultiPolygon {
+	switch g := g.(type) {
+	case orb.Polygon:
+		if len(g) == 0 {
+			return nil
+		}
+		return orb.MultiPolygon{g}
+	case orb.MultiPolygon:
+		var mp orb.MultiPolygon
+		for _, p := range g {
+			mp = append(mp, polygons(p)...)
+		}
+		return mp
+	case orb.Bound:
+		return orb.MultiPolygon{g.ToPolygon()}
+	case orb.Collection:
+		var mp orb.MultiPolygon
+		for _, c := range g {
+			mp = append(mp, polygons(c)...)
+		}
+		return mp
+	}
+	return nil
 }
 
-func toOuterRing(p orb.Polygon) coordinates {
-	if len(p) == 0 {
-		return coordinates{}
+func fromGeom(g geom.Geometry) (orb.MultiPolygon, error) {
+	if g.IsEmpty() {
+		return nil, nil
 	}
-	return coordinates(p[0])
+	og, err := wkb.Unmarshal(g.AsBinary())
+	if err != nil {
+		return nil, err
+	}
+	return polygons(og), nil
 }
 
-// PolyUnion provides union functionality for orb polygons using the geos library.
-func PolyUnion(p1, p2 orb.Polygon) orb.Polygon {
-	var c coordinates
-	c = append(c, toOuterRing(p1)...)
-	c = append(c, toOuterRing(p2)...)
-	h := hull.New(c)
-
-	var ring orb.Ring
-	for i := 0; i < h.Len(); i++ {
-		x, y := h.Take(i)
-		ring = append(ring, orb.Point{x, y})
+// PolyUnion returns the union of two polygonal geometries. Disjoint parts and
+// holes are preserved. Nil or empty geometries are ignored.
+func PolyUnion(g1, g2 orb.Geometry) (orb.MultiPolygon, error) {
+	if len(polygons(g1)) == 0 {
+		return polygons(g2), nil
+	}
+	if len(polygons(g2)) == 0 {
+		return polygons(g1), nil
+	}
+	a, err := toGeom(g1)
+	if err != nil {
+		return nil, fmt.Errorf("convert: %v", err)
+	}
+	b, err := toGeom(g2)
+	if err != nil {
+		return nil, fmt.Errorf("convert: %v", err)
 	}
-	if len(ring) > 0 && !ring.Closed() {
-		ring = append(ring, ring[0])
+	u, err := geom.Union(a, b)
+	if err != nil {
+		return nil, err
 	}
-	return orb.Polygon{ring}
+	return fromGeom(u)
 }
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+)
+
+func square(x0, y0, x1, y1 float64) orb.Polygon {
+	return orb.Bound{Min: orb.Point{x0, y0}, Max: orb.Point{x1, y1}}.ToPolygon()
+}
+
+// withHole is a 3x3 square at the origin with a 1x1 hole in the middle.
+func withHole() orb.Polygon {
+	return orb.Polygon{square(0, 0, 3, 3)[0], square(1, 1, 2, 2)[0]}
+}
+
+func holes(mp orb.MultiPolygon) int {
+	n := 0
+	for _, p := range mp {
+		n += len(p) - 1
+	}
+	return n
+}
+
+func TestPolyUnion(t *testing.T) {
+	tests := []struct {
+		name   string
+		g1, g2 orb.Geometry
+		parts  int
+		holes  int
+		area   float64
+	}{
+		{"disjoint strips", square(0, 0, 1, 4), square(2, 0, 3, 4), 2, 0, 8},
+		{"L shape", square(0, 0, 2, 1), square(0, 0, 1, 2), 1, 0, 3},
+		{"overlapping", square(0, 0, 2, 2), square(1, 1, 3, 3), 1, 0, 7},
+		{"hole kept", withHole(), square(0, 3, 3, 4), 1, 1, 11},
+		{"hole filled", withHole(), square(1, 1, 2, 2), 1, 0, 9},
+		{"multipolygon", orb.MultiPolygon{square(0, 0, 1, 1), square(4, 0, 5, 1)}, square(1, 0, 4, 1), 1, 0, 5},
+		{"nil first", nil, square(0, 0, 1, 1), 1, 0, 1},
+		{"nil second", square(0, 0, 1, 1), nil, 1, 0, 1},
+		{"both nil", nil, nil, 0, 0, 0},
+		{"empty polygon", orb.Polygon{}, square(0, 0, 1, 1), 1, 0, 1},
+		{"empty multipolygon", square(0, 0, 1, 1), orb.MultiPolygon{}, 1, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp, err := PolyUnion(tt.g1, tt.g2)
+			if err != nil {
+				t.Fatalf("PolyUnion: %v", err)
+			}
+			if len(mp) != tt.parts {
+				t.Errorf("got %d parts, want %d", len(mp), tt.parts)
+			}
+			if h := holes(mp); h != tt.holes {
+				t.Errorf("got %d holes, want %d", h, tt.holes)
+			}
+			if a := math.Abs(planar.Area(mp)); math.Abs(a-tt.area) > 1e-9 {
+				t.Errorf("area = %v, want %v", a, tt.area)
+			}
+		})
+	}
+}
+
+func TestGeoUnion(t *testing.T) {
+	tests := []struct {
+		name   string
+		g1, g2 orb.Geometry
+		want   string
+		area   float64
+	}{
+		{"disjoint strips", square(0, 0, 1, 4), square(2, 0, 3, 4), "MultiPolygon", 8},
+		{"L shape", square(0, 0, 2, 1), square(0, 0, 1, 2), "Polygon", 3},
+		{"hole kept", withHole(), square(0, 3, 3, 4), "Polygon", 11},
+		{"nil first", nil, square(0, 0, 1, 1), "Polygon", 1},
+		{"both nil", nil, nil, "MultiPolygon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := GeoUnion(tt.g1, tt.g2)
+			if g.GeoJSONType() != tt.want {
+				t.Errorf("got %s, want %s", g.GeoJSONType(), tt.want)
+			}
+			if a := math.Abs(planar.Area(g)); math.Abs(a-tt.area) > 1e-9 {
+				t.Errorf("area = %v, want %v", a, tt.area)
+			}
+		})
+	}
+}